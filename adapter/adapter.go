@@ -0,0 +1,200 @@
+// Package adapter provides the deflate middleware for net/http servers. It
+// runs the Hertz middleware itself around the net/http handler, so the request
+// decision, the response checks and the header rewrites are the same on both
+// stacks, as are the Options and the compress pools.
+//
+// Responses are buffered until the handler returns. A handler flushing through
+// http.Flusher gets its response sent uncompressed as it is written, like the
+// event streams the Hertz middleware leaves alone. WithFinalWriter has no
+// effect: the net/http server writes the response.
+package adapter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+
+	"deflate"
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+// Deflate returns a net/http middleware compressing responses with the given
+// level, configured by the same options as deflate.Deflate
+func Deflate(level int, options ...deflate.Option) func(http.Handler) http.Handler {
+	options = append(options[:len(options):len(options)], func(o *deflate.Options) {
+		o.FinalWriter = false
+	})
+	middleware := deflate.NewDeflateSrvMiddleware(level, options...)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := app.NewContext(0)
+			body, err := setRequest(c, r, middleware.CurrentOptions())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rw := &responseWriter{w: w, c: c, status: http.StatusOK}
+			c.SetHandlers(app.HandlersChain{middleware.SrvMiddleware, func(ctx context.Context, c *app.RequestContext) {
+				forwardRequestBody(c, r, body)
+				next.ServeHTTP(rw, r)
+				rw.commit()
+			}})
+			c.Next(r.Context())
+			rw.finish()
+		})
+	}
+}
+
+// setRequest copies r to the Hertz request of c. The body is only read, and
+// returned, when the middleware may decompress it.
+func setRequest(c *app.RequestContext, r *http.Request, opts *deflate.Options) ([]byte, error) {
+	req := &c.Request
+	req.SetMethod(r.Method)
+	req.Header.SetProtocol(r.Proto)
+	req.SetRequestURI(r.URL.RequestURI())
+	req.SetHost(r.Host)
+	for key, values := range r.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if opts.DecompressFn == nil || r.Header.Get("Content-Encoding") == "" || r.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBody(body)
+	return body, nil
+}
+
+// forwardRequestBody gives r the body left by the middleware: the inflated one
+// when it decompressed the request, the body read by setRequest otherwise
+func forwardRequestBody(c *app.RequestContext, r *http.Request, body []byte) {
+	if body == nil {
+		return
+	}
+	if encoding := c.Request.Header.Get("Content-Encoding"); encoding == r.Header.Get("Content-Encoding") {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		return
+	}
+	if c.Request.IsBodyStream() {
+		r.Body = io.NopCloser(c.Request.BodyStream())
+		r.ContentLength = -1
+		r.Header.Del("Content-Length")
+	} else {
+		inflated := c.Request.Body()
+		r.Body = io.NopCloser(bytes.NewReader(inflated))
+		r.ContentLength = int64(len(inflated))
+		r.Header.Set("Content-Length", strconv.Itoa(len(inflated)))
+	}
+	r.Header.Del("Content-Encoding")
+}
+
+// responseWriter collects the handler's response into the Hertz response of c,
+// for the middleware to compress once the handler returns
+type responseWriter struct {
+	w       http.ResponseWriter
+	c       *app.RequestContext
+	status  int
+	written bool
+	flushed bool
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.w.Header()
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+		w.status = status
+	}
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.flushed {
+		return w.w.Write(p)
+	}
+	w.c.Response.AppendBody(p)
+	return len(p), nil
+}
+
+// Flush sends what was written so far uncompressed, and the rest of the
+// response as it is written
+func (w *responseWriter) Flush() {
+	if !w.flushed {
+		w.flushed = true
+		w.c.Set(deflate.SkipKey, true)
+		w.WriteHeader(http.StatusOK)
+		w.w.WriteHeader(w.status)
+		_, _ = w.w.Write(w.c.Response.Body())
+		w.c.Response.ResetBody()
+	}
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// commit copies the status and headers set by the handler to the Hertz response
+func (w *responseWriter) commit() {
+	if w.flushed {
+		return
+	}
+	resp := &w.c.Response
+	resp.SetStatusCode(w.status)
+	resp.Header.SetNoDefaultContentType(true)
+	for key, values := range w.w.Header() {
+		switch key {
+		case "Set-Cookie", "Content-Length":
+			// cookies stay in the net/http header, the length is recomputed
+			continue
+		}
+		for _, value := range values {
+			resp.Header.Add(key, value)
+		}
+	}
+	if body := resp.Body(); len(body) > 0 && len(resp.Header.ContentType()) == 0 && bodyAllowed(w.status) {
+		// as net/http does for the uncompressed body
+		resp.Header.SetContentType(http.DetectContentType(body))
+	}
+}
+
+// finish writes the response processed by the middleware to the net/http writer
+func (w *responseWriter) finish() {
+	if w.flushed {
+		return
+	}
+	resp := &w.c.Response
+	status := resp.StatusCode()
+	body := resp.Body()
+	header := w.w.Header()
+	for key := range header {
+		if key != "Set-Cookie" {
+			delete(header, key)
+		}
+	}
+	resp.Header.VisitAll(func(key, value []byte) {
+		switch k := string(key); k {
+		case "Set-Cookie", "Content-Length":
+		default:
+			header.Add(k, string(value))
+		}
+	})
+	if bodyAllowed(status) {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.w.WriteHeader(status)
+	if bodyAllowed(status) {
+		_, _ = w.w.Write(body)
+	}
+}
+
+// bodyAllowed reports whether a response with the given status may have a body
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
@@ -0,0 +1,160 @@
+package adapter
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"deflate"
+	"deflate/compress"
+	"github.com/stretchr/testify/assert"
+)
+
+const testResponse = "Deflate Test Response"
+
+func newHandler(options ...deflate.Option) http.Handler {
+	return Deflate(deflate.DefaultCompression, options...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(testResponse))
+	}))
+}
+
+func TestDeflate(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "deflate")
+	w := httptest.NewRecorder()
+	newHandler().ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "deflate", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+	inflated, err := compress.AppendInflateBytes(nil, w.Body.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(inflated))
+}
+
+func TestNoDeflate(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	newHandler().ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, testResponse, w.Body.String())
+}
+
+func TestExcludedPaths(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/books", nil)
+	r.Header.Set("Accept-Encoding", "deflate")
+	w := httptest.NewRecorder()
+	newHandler(deflate.WithExcludedPaths([]string{"/api/"})).ServeHTTP(w, r)
+
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, testResponse, w.Body.String())
+}
+
+func TestPadding(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "deflate")
+	w := httptest.NewRecorder()
+	newHandler(deflate.WithPadding(64)).ServeHTTP(w, r)
+
+	assert.Equal(t, "deflate", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, 0, w.Body.Len()%64)
+	assert.Equal(t, strconv.Itoa(w.Body.Len()), w.Header().Get("Content-Length"))
+	inflated, err := compress.AppendInflateBytes(nil, w.Body.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(inflated))
+}
+
+func TestETagAndIntegrity(t *testing.T) {
+	handler := Deflate(deflate.DefaultCompression, deflate.WithETagPolicy(deflate.ETagWeaken))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-MD5", "stale")
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+			_, _ = w.Write([]byte(testResponse))
+		}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "deflate")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	assert.Equal(t, "deflate", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, `W/"v1"`, w.Header().Get("ETag"))
+	assert.Equal(t, "", w.Header().Get("Content-MD5"))
+	assert.Equal(t, "session=1", w.Header().Get("Set-Cookie"))
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+}
+
+func TestSkippedResponses(t *testing.T) {
+	for name, fn := range map[string]http.HandlerFunc{
+		"event stream": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte(testResponse))
+		},
+		"too small": func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("small"))
+		},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "deflate")
+		w := httptest.NewRecorder()
+		Deflate(deflate.DefaultCompression, deflate.WithExcludedSizeRange(10, 0))(fn).ServeHTTP(w, r)
+		assert.Equal(t, "", w.Header().Get("Content-Encoding"), name)
+	}
+}
+
+func TestNoContent(t *testing.T) {
+	for _, status := range []int{http.StatusNoContent, http.StatusNotModified} {
+		handler := Deflate(deflate.DefaultCompression)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "deflate")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, status, w.Code)
+		assert.Equal(t, "", w.Header().Get("Content-Length"))
+		assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestFlusher(t *testing.T) {
+	handler := Deflate(deflate.DefaultCompression)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("first "))
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte(testResponse))
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "deflate")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	assert.True(t, w.Flushed)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "first "+testResponse, w.Body.String())
+}
+
+func TestDecompression(t *testing.T) {
+	handler := Deflate(deflate.DefaultCompression, deflate.WithDecompressFn(deflate.DefaultDecompressHandle))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			assert.Equal(t, "", r.Header.Get("Content-Encoding"))
+			assert.Equal(t, int64(len(body)), r.ContentLength)
+			_, _ = w.Write(body)
+		}))
+	deflated, _ := compress.AppendDeflateBytesLevel(nil, []byte(testResponse), deflate.DefaultCompression)
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(deflated))
+	r.Header.Set("Content-Encoding", "deflate")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, testResponse, w.Body.String())
+}
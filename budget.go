@@ -0,0 +1,82 @@
+package deflate
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// MemoryBudget bounds the bytes held by compressed bodies until they are sent.
+// A single budget may be shared by several middlewares to bound them together.
+type MemoryBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// NewMemoryBudget returns a budget allowing at most limit bytes in flight
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit}
+}
+
+// TryAcquire reserves n bytes, reporting false when that would exceed the limit
+func (b *MemoryBudget) TryAcquire(n int64) bool {
+	if b.used.Add(n) > b.limit {
+		b.used.Add(-n)
+		return false
+	}
+	return true
+}
+
+// Release returns n bytes previously reserved by TryAcquire
+func (b *MemoryBudget) Release(n int64) {
+	b.used.Add(-n)
+}
+
+// InUse returns the bytes currently reserved
+func (b *MemoryBudget) InUse() int64 {
+	return b.used.Load()
+}
+
+// reservation is a reservation of a MemoryBudget, released at most once
+type reservation struct {
+	budget *MemoryBudget
+	n      int64
+}
+
+// reserve reserves n bytes of budget, reporting false when that would exceed
+// its limit. A nil budget grants every reservation.
+func reserve(budget *MemoryBudget, n int) (*reservation, bool) {
+	if budget == nil || !budget.TryAcquire(int64(n)) {
+		return &reservation{}, budget == nil
+	}
+	return &reservation{budget: budget, n: int64(n)}, true
+}
+
+// take moves the reservation to the returned one, e.g. to release it with the
+// body holding the reserved bytes, and leaves r empty
+func (r *reservation) take() *reservation {
+	taken := *r
+	r.budget = nil
+	return &taken
+}
+
+func (r *reservation) release() {
+	if r.budget != nil {
+		r.budget.Release(r.n)
+		r.budget = nil
+	}
+}
+
+// budgetReader releases its reservation once closed, which the server does
+// once it sent the body, or when the body is replaced
+type budgetReader struct {
+	io.Reader
+	r *reservation
+}
+
+func (b *budgetReader) Close() error {
+	b.r.release()
+	if c, ok := b.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
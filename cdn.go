@@ -0,0 +1,44 @@
+package deflate
+
+import (
+	"net/http"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol"
+)
+
+// cdnSkip reports whether a response must be left as is for caches in front of
+// the server: partial and not modified responses describe the identity
+// representation, and no-transform forbids intermediaries from changing it
+func (d *DeflateSrvMiddleware) cdnSkip(c *app.RequestContext) bool {
+	switch c.Response.StatusCode() {
+	case http.StatusPartialContent, http.StatusNotModified:
+		return true
+	}
+	return len(c.Request.Header.Peek("Range")) > 0 ||
+		hasHeaderToken(c.Response.Header.Get("Cache-Control"), "no-transform")
+}
+
+// cdnCompressed reports whether req carries one of the headers telling that the
+// CDN compresses the responses itself
+func (o *Options) cdnCompressed(req *protocol.Request) bool {
+	for _, key := range o.CDNSkipHeaders {
+		if len(req.Header.Peek(key)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// addVary adds value to the Vary header of h, keeping the values already there
+func addVary(h *protocol.ResponseHeader, value string) {
+	vary := h.Get("Vary")
+	if vary == "" {
+		h.Set("Vary", value)
+		return
+	}
+	if vary == "*" || hasHeaderToken(vary, value) {
+		return
+	}
+	h.Set("Vary", vary+", "+value)
+}
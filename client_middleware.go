@@ -3,7 +3,8 @@ package deflate
 import (
 	"bytes"
 	"context"
-	"path/filepath"
+	"hash/crc32"
+	"io"
 	"strings"
 
 	"deflate/compress"
@@ -11,65 +12,221 @@ import (
 	"github.com/cloudwego/hertz/pkg/protocol"
 )
 
-type deflateClientMiddleware struct {
+// octetStreamContentType replaces the Content-Type of the responses inflated
+// because of it
+var octetStreamContentType = []byte("application/octet-stream")
+
+// DeflateClientMiddleware is the client middleware returned by DeflateForClient. It can be
+// embedded to customize its decisions, e.g. by setting ShouldCompressFunc.
+type DeflateClientMiddleware struct {
 	*ClientOptions
 	level int
+
+	// ShouldCompressFunc replaces ShouldCompress when set
+	ShouldCompressFunc func(req *protocol.Request) bool
 }
 
-func newDeflateClientMiddleware(level int, opts ...ClientOption) *deflateClientMiddleware {
-	middleware := &deflateClientMiddleware{
-		ClientOptions: DefaultClientOptions,
+func NewDeflateClientMiddleware(level int, opts ...ClientOption) *DeflateClientMiddleware {
+	options := *DefaultClientOptions
+	middleware := &DeflateClientMiddleware{
+		ClientOptions: &options,
 		level:         level,
 	}
 	for _, fn := range opts {
 		fn(middleware.ClientOptions)
 	}
+	middleware.excludedPathTrie = compilePaths(middleware.ExcludedPaths)
 	return middleware
 }
 
-func (d *deflateClientMiddleware) ClientMiddleware(next client.Endpoint) client.Endpoint {
+// ClientMiddleware compresses the request body once before next and inflates
+// the response after it. The retries of the Hertz client happen within next, so
+// they send the same compressed body and only the response of the last attempt
+// is inflated. Retry middlewares added after this one behave the same, and an
+// already encoded request body isn't compressed again by those added before.
+func (d *DeflateClientMiddleware) ClientMiddleware(next client.Endpoint) client.Endpoint {
 	return func(ctx context.Context, req *protocol.Request, resp *protocol.Response) (err error) {
-		if !d.shouldCompress(req) {
-			return
+		shouldCompress := d.ShouldCompress
+		if d.ShouldCompressFunc != nil {
+			shouldCompress = d.ShouldCompressFunc
 		}
-		req.SetHeader("Content-Encoding", "deflate")
-		req.SetHeader("Vary", "Accept-Encoding")
-		if len(req.Body()) > 0 {
-			gzipBytes, err1 := compress.AppendDeflateBytesLevel(nil, req.Body(), d.level)
-			if err1 != nil {
-				return
+		var stats ClientStats
+		compressed := false
+		if shouldCompress(req) && !IsRequestEncoded(req) {
+			restore := d.RestoreBody && !d.StreamingUploads
+			var body []byte
+			var vary string
+			if restore {
+				body, vary = req.Body(), string(req.Header.Peek("Vary"))
+			}
+			var reserved *reservation
+			stats, reserved, compressed = d.compressRequest(req)
+			// the compressed body is held until the request is sent
+			defer reserved.release()
+			if compressed && restore {
+				// the original body is left untouched by compressRequest
+				defer restoreRequest(req, body, vary)
 			}
-			req.SetBodyStream(bytes.NewBuffer(gzipBytes), len(gzipBytes))
 		}
 		err = next(ctx, req, resp)
+		if compressed {
+			stats.Err = err
+			d.reportClient(req, resp, stats)
+		}
 		if err != nil {
 			return
 		}
-		if fn := d.DecompressFnForClient; fn != nil && strings.EqualFold(resp.Header.Get("Content-Encoding"), "deflate") {
-			f := fn(next)
-			err = f(ctx, req, resp)
-			if err != nil {
+		fn := d.DecompressFnForClient
+		if fn == nil {
+			return nil
+		}
+		if d.isDeflateEncoded(resp.Header.Get("Content-Encoding")) {
+			return fn(next)(ctx, req, resp)
+		}
+		if d.isDeflateContentType(&resp.Header) {
+			if err = fn(next)(ctx, req, resp); err != nil {
 				return err
 			}
+			resp.Header.SetContentTypeBytes(octetStreamContentType)
 		}
 		return nil
 	}
 }
 
-func (d *deflateClientMiddleware) shouldCompress(req *protocol.Request) bool {
-	if strings.Contains(req.Header.Get("Connection"), "Upgrade") ||
-		strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+// isDeflateEncoded reports whether the response Content-Encoding header is deflate
+func (d *DeflateClientMiddleware) isDeflateEncoded(header string) bool {
+	return withinHeaderLimits(header, DefaultMaxEncodingHeaderLength, DefaultMaxEncodingTokens) &&
+		isContentEncoding(header, "deflate", d.LegacyEncodings)
+}
+
+// isDeflateContentType reports whether the response has no Content-Encoding
+// and one of the DecompressContentTypes
+func (d *DeflateClientMiddleware) isDeflateContentType(header *protocol.ResponseHeader) bool {
+	if len(d.DecompressContentTypes) == 0 || len(header.Peek("Content-Encoding")) > 0 {
+		return false
+	}
+	mediaType, _, _ := strings.Cut(string(header.ContentType()), ";")
+	return d.DecompressContentTypes[strings.ToLower(strings.TrimSpace(mediaType))]
+}
+
+// compressRequest compresses the body of req and reports whether it did, along
+// with the reservation of the MemoryBudget to release once req is sent
+func (d *DeflateClientMiddleware) compressRequest(req *protocol.Request) (ClientStats, *reservation, bool) {
+	if d.StreamingUploads {
+		return ClientStats{CompressedSize: -1, UncompressedSize: -1}, &reservation{}, d.streamRequest(req)
+	}
+	body := req.Body()
+	reserved, ok := reserve(d.MemoryBudget, 2*len(body))
+	if !ok {
+		return ClientStats{}, reserved, false
+	}
+	stats := ClientStats{UncompressedSize: len(body)}
+
+	if len(body) > 0 {
+		level := d.level
+		if d.AdaptiveLevel {
+			level = adaptiveLevel(level, len(body))
+		}
+		var deflateBytes []byte
+		var err error
+		if d.Pools != nil {
+			deflateBytes, err = d.Pools.AppendDeflateBytesLevel(nil, body, level)
+		} else {
+			deflateBytes, err = compress.AppendDeflateBytesLevel(nil, body, level)
+		}
+		if err != nil {
+			reserved.release()
+			return ClientStats{}, reserved, false
+		}
+		if d.ChunkedUploads {
+			setRequestBody(req, nil)
+			req.ConstructBodyStream(nil, bytes.NewReader(deflateBytes))
+			req.Header.SetContentLength(-1)
+		} else {
+			// a body stream would be consumed by the first attempt of a retried request
+			setRequestBody(req, deflateBytes)
+		}
+		stats.CompressedSize = len(deflateBytes)
+	}
+	d.setEncodingHeaders(req)
+	return stats, reserved, true
+}
+
+// setEncodingHeaders sets the Content-Encoding of a compressed request and its
+// Vary header, once its body is replaced
+func (d *DeflateClientMiddleware) setEncodingHeaders(req *protocol.Request) {
+	req.SetHeader("Content-Encoding", "deflate")
+	if !d.DisableVary {
+		req.SetHeader("Vary", "Accept-Encoding")
+	}
+}
+
+// setRequestBody replaces the body of req by body. The buffer holding the
+// previous body is detached from req rather than overwritten or returned to its
+// pool, so slices of it kept by the caller, e.g. to send a hedged request,
+// remain valid.
+func setRequestBody(req *protocol.Request, body []byte) {
+	req.ConstructBodyStream(nil, nil)
+	req.SetBodyRaw(body)
+}
+
+// restoreRequest undoes compressRequest, setting back the original body and
+// Vary header of req
+func restoreRequest(req *protocol.Request, body []byte, vary string) {
+	req.Header.Del("Content-Encoding")
+	if vary == "" {
+		req.Header.Del("Vary")
+	} else {
+		req.Header.Set("Vary", vary)
+	}
+	setRequestBody(req, body)
+}
+
+// streamRequest replaces the body of req by its deflate encoding, compressed
+// while the request is sent with chunked transfer encoding, followed by the
+// size and CRC-32 of the body as trailers
+func (d *DeflateClientMiddleware) streamRequest(req *protocol.Request) bool {
+	var src io.Reader
+	if req.IsBodyStream() {
+		src = req.BodyStream()
+	} else if body := req.Body(); len(body) > 0 {
+		src = bytes.NewReader(body)
+	} else {
+		return false
+	}
+	level := d.level
+	if d.AdaptiveLevel {
+		// the size of a stream isn't known, treat it as a large body
+		level = adaptiveLevel(level, adaptiveLargeBodySize)
+	}
+	trailer := req.Header.Trailer()
+	trailer.Set(HeaderUncompressedLength, "")
+	trailer.Set(HeaderUncompressedCRC32, "")
+	src = &trailerReader{r: src, crc: crc32.NewIEEE(), trailer: trailer}
+	// unlike SetBodyStream, ConstructBodyStream neither closes the original
+	// stream nor reuses the buffer of the original body
+	req.ConstructBodyStream(nil, compress.NewDeflateReader(src, level))
+	req.Header.SetContentLength(-1)
+	d.setEncodingHeaders(req)
+	return true
+}
+
+// ShouldCompress reports whether the body of req may be compressed
+func (d *DeflateClientMiddleware) ShouldCompress(req *protocol.Request) bool {
+	if len(d.IncludedMethods) > 0 && !d.IncludedMethods[string(req.Method())] {
+		return false
+	}
+	if isStreamingRequest(req) {
 		return false
 	}
 
 	path := string(req.URI().RequestURI())
 
-	extension := filepath.Ext(path)
-	if d.ExcludedExtensions.Contains(extension) {
+	if d.ExcludedExtensions.Matches(path) {
 		return false
 	}
 
-	if d.ExcludedPaths.Contains(path) {
+	if excludesPath(d.ExcludedPaths, d.excludedPathTrie, path) {
 		return false
 	}
 	if d.ExcludedPathRegexes.Contains(path) {
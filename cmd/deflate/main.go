@@ -0,0 +1,126 @@
+// Command deflate compresses or decompresses a file, or stdin, with the same
+// settings as the middleware and prints size statistics to stderr, to check
+// what the middleware would have produced for a given payload.
+//
+//	deflate [-d] [-q] [-raw] [-level n] [-dict file] [file]
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"deflate/compress"
+)
+
+func main() {
+	decompress := flag.Bool("d", false, "decompress instead of compressing")
+	raw := flag.Bool("raw", false, "use raw deflate (RFC 1951) instead of zlib (RFC 1950), which the middleware writes")
+	level := flag.Int("level", compress.CompressDefaultCompression, "compression level, -2 (huffman only) to 9")
+	dictFile := flag.String("dict", "", "file holding a preset dictionary")
+	quiet := flag.Bool("q", false, "don't print statistics")
+	flag.Parse()
+
+	if err := run(*decompress, *raw, *level, *dictFile, *quiet); err != nil {
+		fmt.Fprintln(os.Stderr, "deflate:", err)
+		os.Exit(1)
+	}
+}
+
+func run(decompress, raw bool, level int, dictFile string, quiet bool) error {
+	in := io.Reader(os.Stdin)
+	if flag.NArg() > 1 {
+		return fmt.Errorf("at most one input file expected")
+	}
+	if flag.NArg() == 1 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	src, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	var dict []byte
+	if dictFile != "" {
+		if dict, err = os.ReadFile(dictFile); err != nil {
+			return err
+		}
+	}
+
+	var dst []byte
+	if decompress {
+		dst, err = inflate(src, raw, dict)
+	} else {
+		dst, err = deflate(src, raw, level, dict)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stdout.Write(dst); err != nil {
+		return err
+	}
+
+	if !quiet {
+		plain, compressed := len(src), len(dst)
+		if decompress {
+			plain, compressed = compressed, plain
+		}
+		ratio := 0.0
+		if plain > 0 {
+			ratio = float64(compressed) / float64(plain)
+		}
+		fmt.Fprintf(os.Stderr, "plain: %d bytes, compressed: %d bytes, ratio: %.3f, saved: %d bytes\n",
+			plain, compressed, ratio, plain-compressed)
+	}
+	return nil
+}
+
+func deflate(src []byte, raw bool, level int, dict []byte) ([]byte, error) {
+	if !raw && dict == nil {
+		// exactly what the middleware writes
+		return compress.AppendDeflateBytesLevel(nil, src, level)
+	}
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	if raw {
+		w, err = flate.NewWriterDict(&buf, level, dict)
+	} else {
+		w, err = zlib.NewWriterLevelDict(&buf, level, dict)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(src); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func inflate(src []byte, raw bool, dict []byte) ([]byte, error) {
+	if !raw && dict == nil {
+		return compress.AppendInflateBytes(nil, src)
+	}
+	var r io.ReadCloser
+	if raw {
+		r = flate.NewReaderDict(bytes.NewReader(src), dict)
+	} else {
+		var err error
+		if r, err = zlib.NewReaderDict(bytes.NewReader(src), dict); err != nil {
+			return nil, err
+		}
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -43,15 +43,16 @@ package compress
 
 import (
 	"bytes"
+	"compress/gzip"
 	"compress/zlib"
+	"encoding/binary"
 	"fmt"
+	"hash/adler32"
 	"io"
 	"sync"
 
 	"github.com/cloudwego/hertz/pkg/common/bytebufferpool"
 	"github.com/cloudwego/hertz/pkg/common/stackless"
-	"github.com/cloudwego/hertz/pkg/common/utils"
-	"github.com/cloudwego/hertz/pkg/network"
 )
 
 const CompressDefaultCompression = 6 // flate.DefaultCompression
@@ -72,6 +73,18 @@ type compressCtx struct {
 	w     io.Writer
 	p     []byte
 	level int
+	// flushAt are the offsets of p at which the stream is sync flushed, and
+	// flushEnds the lengths of w at those flushes when w is a byteSliceWriter
+	flushAt   []int
+	flushEnds []int
+}
+
+// compressCtxPool holds the contexts of WriteDeflateLevel calls, the per-P
+// caches of sync.Pool keeping them from contending under high QPS
+var compressCtxPool = sync.Pool{
+	New: func() interface{} {
+		return &compressCtx{}
+	},
 }
 
 type byteSliceWriter struct {
@@ -96,15 +109,35 @@ func (r *byteSliceReader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+// ReadByte makes byteSliceReader an io.ByteReader, so the inflaters read it
+// directly instead of allocating a bufio.Reader around it
+func (r *byteSliceReader) ReadByte() (byte, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c, nil
+}
+
 // normalizes compression level into [0..11], so it could be used as an index
 // in *PoolMap.
 func normalizeCompressLevel(level int) int {
+	return clampCompressLevel(level) + 2
+}
+
+// clampCompressLevel clamps an invalid compression level to the lowest or the
+// highest one, so its writers are pooled with those of the level they use.
+func clampCompressLevel(level int) int {
 	// -2 is the lowest compression level - CompressHuffmanOnly
 	// 9 is the highest compression level - CompressBestCompression
-	if level < -2 || level > 9 {
-		level = CompressDefaultCompression
+	if level < zlib.HuffmanOnly {
+		return zlib.HuffmanOnly
 	}
-	return level + 2
+	if level > zlib.BestCompression {
+		return zlib.BestCompression
+	}
+	return level
 }
 
 func acquireFlateReader(r io.Reader) (io.ReadCloser, error) {
@@ -139,6 +172,15 @@ func resetFlateReader(zr io.ReadCloser, r io.Reader) error {
 
 var flateReaderPool sync.Pool
 
+// copyBufPool holds the buffers used to copy data between plain io.Readers and
+// io.Writers
+var copyBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 4096)
+		return &buf
+	},
+}
+
 // AppendDeflateBytesLevel appends deflated src to dst using the given
 // compression level and returns the resulting dst.
 //
@@ -155,6 +197,120 @@ func AppendDeflateBytesLevel(dst, src []byte, level int) ([]byte, error) {
 	return w.b, err
 }
 
+// AppendDeflateBytesLevelFlushed is like AppendDeflateBytesLevel, but sync
+// flushes the stream at each of the offsets of src in flushAt, which must be
+// increasing: a peer can inflate src[:flushAt[i]] from dst[:ends[i]] without
+// the rest of the stream, e.g. to send each part as a chunk or event.
+func AppendDeflateBytesLevelFlushed(dst, src []byte, level int, flushAt []int) (res []byte, ends []int, err error) {
+	prev := 0
+	for _, off := range flushAt {
+		if off < prev || off > len(src) {
+			return dst, nil, fmt.Errorf("invalid flush offset %d", off)
+		}
+		prev = off
+	}
+	w := &byteSliceWriter{dst}
+	ends = make([]int, len(flushAt))
+	stacklessWriteDeflate(&compressCtx{
+		w:         w,
+		p:         src,
+		level:     level,
+		flushAt:   flushAt,
+		flushEnds: ends,
+	})
+	return w.b, ends, nil
+}
+
+// AppendDeflateBytesLevelPadded is like AppendDeflateBytesLevel, but pads the
+// zlib stream with empty deflate blocks by at least padding bytes, see PaddingSize.
+func AppendDeflateBytesLevelPadded(dst, src []byte, level, padding int) ([]byte, error) {
+	return AppendDeflateBytesLevelPaddedFunc(dst, src, level, func(int) int {
+		return padding
+	})
+}
+
+// AppendDeflateBytesLevelPaddedFunc is like AppendDeflateBytesLevelPadded, but
+// the padding is returned by padding given the length n of the unpadded stream.
+// The deflate data is sync flushed, followed by the empty padding blocks, the
+// final block and the checksum.
+func AppendDeflateBytesLevelPaddedFunc(dst, src []byte, level int, padding func(n int) int) ([]byte, error) {
+	w := &byteSliceWriter{dst}
+	zw := acquireRealDeflateWriter(w, level)
+	_, err := zw.Write(src)
+	if err == nil {
+		err = zw.Flush()
+	}
+	zw.Reset(io.Discard)
+	releaseRealDeflateWriter(zw, level)
+	if err != nil {
+		return w.b, err
+	}
+
+	// the final empty stored block and the adler-32 checksum
+	const trailerSize = 9
+	n := len(w.b) - len(dst) + trailerSize
+	w.b = appendEmptyBlocks(w.b, PaddingSize(padding(n)))
+	w.b = append(w.b, 0x01, 0x00, 0x00, 0xff, 0xff)
+	return binary.BigEndian.AppendUint32(w.b, adler32.Checksum(src)), nil
+}
+
+// PaddingSize returns the smallest padding of at least n bytes that empty
+// deflate blocks can express: 0, 5, 6, 7 and anything from 9 bytes on.
+func PaddingSize(n int) int {
+	switch {
+	case n <= 0:
+		return 0
+	case n < 5:
+		return 5
+	case n == 8:
+		return 9
+	default:
+		return n
+	}
+}
+
+// BlockPaddingSize returns the smallest valid PaddingSize that pads n bytes
+// to a multiple of block bytes.
+func BlockPaddingSize(n, block int) int {
+	if block <= 1 {
+		return 0
+	}
+	padding := (block - n%block) % block
+	for PaddingSize(padding) != padding {
+		padding += block
+	}
+	return padding
+}
+
+// appendEmptyBlocks appends exactly n bytes of non-final empty deflate blocks,
+// n must be a valid PaddingSize. Each run of m empty fixed-Huffman blocks
+// closed by an empty stored block takes ceil((10m+3)/8)+4 bytes: 5, 6, 7 or 9
+// bytes for m = 0..3, and any other valid size is a sum of those.
+func appendEmptyBlocks(dst []byte, n int) []byte {
+	for n > 0 {
+		for _, m := range []int{3, 2, 1, 0} {
+			size := (10*m+3+7)/8 + 4
+			if rest := n - size; rest == 0 || rest >= 5 && rest != 8 {
+				dst = appendEmptyBlockRun(dst, m)
+				n -= size
+				break
+			}
+		}
+	}
+	return dst
+}
+
+func appendEmptyBlockRun(dst []byte, m int) []byte {
+	header := make([]byte, (10*m+3+7)/8)
+	for i := 0; i < m; i++ {
+		// BFINAL=0, BTYPE=01 (fixed Huffman) then the all-zero end-of-block code
+		bit := 10*i + 1
+		header[bit/8] |= 1 << (bit % 8)
+	}
+	// the stored block header bits are zero, LEN=0 and NLEN=0xffff follow
+	return append(append(dst, header...), 0x00, 0x00, 0xff, 0xff)
+}
+
 // WriteDeflateLevel writes deflated p to w using the given compression level
 // and returns the number of compressed bytes written to w.
 //
@@ -171,12 +327,11 @@ func WriteDeflateLevel(w io.Writer, p []byte, level int) (int, error) {
 		*bytes.Buffer,
 		*bytebufferpool.ByteBuffer:
 		// These writers don't block, so we can just use stacklessWriteDeflate
-		ctx := &compressCtx{
-			w:     w,
-			p:     p,
-			level: level,
-		}
+		ctx := compressCtxPool.Get().(*compressCtx)
+		ctx.w, ctx.p, ctx.level = w, p, level
 		stacklessWriteDeflate(ctx)
+		*ctx = compressCtx{}
+		compressCtxPool.Put(ctx)
 		return len(p), nil
 	default:
 		zw := AcquireStacklessDeflateWriter(w, level)
@@ -187,37 +342,40 @@ func WriteDeflateLevel(w io.Writer, p []byte, level int) (int, error) {
 }
 
 var (
-	stacklessWriteDeflateOnce sync.Once
-	stacklessWriteDeflateFunc func(ctx interface{}) bool
+	stacklessWriteDeflateOnce  sync.Once
+	stacklessWriteDeflateFuncs *shardedFunc
 )
 
 func stacklessWriteDeflate(ctx interface{}) {
 	stacklessWriteDeflateOnce.Do(func() {
-		stacklessWriteDeflateFunc = stackless.NewFunc(nonblockingWriteDeflate)
+		stacklessWriteDeflateFuncs = newShardedFunc(nonblockingWriteDeflate, stacklessShards())
 	})
-	stacklessWriteDeflateFunc(ctx)
+	stacklessWriteDeflateFuncs.call(ctx)
 }
 
 func nonblockingWriteDeflate(ctxv interface{}) {
 	ctx := ctxv.(*compressCtx)
 	zw := acquireRealDeflateWriter(ctx.w, ctx.level)
 
-	zw.Write(ctx.p) //nolint:errcheck // no way to handle this error anyway
+	prev := 0
+	for i, off := range ctx.flushAt {
+		zw.Write(ctx.p[prev:off]) //nolint:errcheck // no way to handle this error anyway
+		zw.Flush()                //nolint:errcheck // no way to handle this error anyway
+		if w, ok := ctx.w.(*byteSliceWriter); ok {
+			ctx.flushEnds[i] = len(w.b)
+		}
+		prev = off
+	}
+	zw.Write(ctx.p[prev:]) //nolint:errcheck // no way to handle this error anyway
 
 	releaseRealDeflateWriter(zw, ctx.level)
 }
 
 // WriteInflate writes inflated p to w and returns the number of uncompressed
-// bytes written to w.
+// bytes written to w. It fails when that number overflows int, which
+// WriteInflate64 doesn't.
 func WriteInflate(w io.Writer, p []byte) (int, error) {
-	r := &byteSliceReader{p}
-	zr, err := acquireFlateReader(r)
-	if err != nil {
-		return 0, err
-	}
-	zw := network.NewWriter(w)
-	n, err := utils.CopyZeroAlloc(zw, zr)
-	releaseFlateReader(zr)
+	n, err := WriteInflate64(w, p)
 	nn := int(n)
 	if int64(nn) != n {
 		return 0, fmt.Errorf("too much data inflated: %d", n)
@@ -225,6 +383,26 @@ func WriteInflate(w io.Writer, p []byte) (int, error) {
 	return nn, err
 }
 
+// WriteInflate64 writes inflated p to w and returns the number of uncompressed
+// bytes written to w.
+func WriteInflate64(w io.Writer, p []byte) (int64, error) {
+	return WriteInflateReader(w, &byteSliceReader{p})
+}
+
+// WriteInflateReader writes the inflated data read from r to w and returns the
+// number of uncompressed bytes written to w.
+func WriteInflateReader(w io.Writer, r io.Reader) (int64, error) {
+	zr, err := acquireFlateReader(r)
+	if err != nil {
+		return 0, err
+	}
+	buf := copyBufPool.Get().(*[]byte)
+	n, err := io.CopyBuffer(w, zr, *buf)
+	copyBufPool.Put(buf)
+	releaseFlateReader(zr)
+	return n, err
+}
+
 // AppendInflateBytes appends inflated src to dst and returns the resulting dst.
 func AppendInflateBytes(dst, src []byte) ([]byte, error) {
 	w := &byteSliceWriter{dst}
@@ -232,6 +410,64 @@ func AppendInflateBytes(dst, src []byte) ([]byte, error) {
 	return w.b, err
 }
 
+// VerifyZlibChecksum inflates the zlib stream p without keeping the output and
+// reports whether it is valid and matches its Adler-32 trailer, which is
+// zlib.ErrChecksum otherwise.
+func VerifyZlibChecksum(p []byte) error {
+	_, err := WriteInflate64(io.Discard, p)
+	return err
+}
+
+// AppendInflateConcatenatedBytes appends the inflated content of all the zlib
+// members concatenated in src to dst and returns the resulting dst, where
+// AppendInflateBytes stops after the first member.
+func AppendInflateConcatenatedBytes(dst, src []byte) ([]byte, error) {
+	w := &byteSliceWriter{dst}
+	// bytes.Reader is an io.ByteReader, so the inflater doesn't read ahead
+	// into the next member
+	r := bytes.NewReader(src)
+	for r.Len() > 0 {
+		zr, err := acquireFlateReader(r)
+		if err != nil {
+			return w.b, err
+		}
+		_, err = io.Copy(w, zr)
+		releaseFlateReader(zr)
+		if err != nil {
+			return w.b, err
+		}
+	}
+	return w.b, nil
+}
+
+// TranscodeGzipToDeflate appends the deflate encoding of the gzipped src to dst
+// and returns the resulting dst.
+func TranscodeGzipToDeflate(dst, src []byte, level int) ([]byte, error) {
+	w := &byteSliceWriter{dst}
+	_, err := WriteTranscodeGzipToDeflate(w, &byteSliceReader{src}, level)
+	return w.b, err
+}
+
+// WriteTranscodeGzipToDeflate reads gzipped data from r, writes its deflate
+// encoding to w and returns the number of uncompressed bytes transcoded.
+func WriteTranscodeGzipToDeflate(w io.Writer, r io.Reader, level int) (int64, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gr.Close()
+	zw := acquireRealDeflateWriter(w, level)
+	n, err := io.Copy(zw, gr)
+	if err == nil {
+		err = zw.Close()
+	}
+	// releaseRealDeflateWriter would close it again, appending a second
+	// checksum to the finished stream or finishing a broken one
+	zw.Reset(io.Discard)
+	releaseRealDeflateWriter(zw, level)
+	return n, err
+}
+
 func AcquireStacklessDeflateWriter(w io.Writer, level int) stackless.Writer {
 	nLevel := normalizeCompressLevel(level)
 	p := stacklessDeflateWriterPoolMap[nLevel]
@@ -258,17 +494,8 @@ func acquireRealDeflateWriter(w io.Writer, level int) *zlib.Writer {
 	p := realDeflateWriterPoolMap[nLevel]
 	v := p.Get()
 	if v == nil {
-		zw, err := zlib.NewWriterLevel(w, level)
-		if err != nil {
-			// zlib.NewWriterLevel only errors for invalid
-			// compression levels. Clamp it to be min or max.
-			if level < zlib.HuffmanOnly {
-				level = zlib.HuffmanOnly
-			} else {
-				level = zlib.BestCompression
-			}
-			zw, _ = zlib.NewWriterLevel(w, level)
-		}
+		// zlib.NewWriterLevel only errors for invalid compression levels
+		zw, _ := zlib.NewWriterLevel(w, clampCompressLevel(level))
 		return zw
 	}
 	zw := v.(*zlib.Writer)
@@ -283,7 +510,72 @@ func releaseRealDeflateWriter(zw *zlib.Writer, level int) {
 	p.Put(zw)
 }
 
+// PrewarmPools allocates n deflate writers of the given compression level and
+// puts them into the writer pools, so the first compressions after startup
+// don't pay for the allocation. Pooled writers may still be dropped by the GC.
+func PrewarmPools(level, n int) {
+	zws := make([]*zlib.Writer, 0, n)
+	sws := make([]stackless.Writer, 0, n)
+	for i := 0; i < n; i++ {
+		zws = append(zws, acquireRealDeflateWriter(io.Discard, level))
+		sws = append(sws, AcquireStacklessDeflateWriter(io.Discard, level))
+	}
+	for i := 0; i < n; i++ {
+		releaseRealDeflateWriter(zws[i], level)
+		releaseStacklessDeflateWriter(sws[i], level)
+	}
+}
+
 var (
 	stacklessDeflateWriterPoolMap = newCompressWriterPoolMap()
 	realDeflateWriterPoolMap      = newCompressWriterPoolMap()
 )
+
+// selfTestPayload is compressible enough to exercise the deflate encoder
+var selfTestPayload = bytes.Repeat([]byte("compress self test payload 0123456789 "), 64)
+
+// SelfTest compresses and inflates back a payload at every level through both
+// the non-blocking and the stackless writer paths, taking writers from the
+// pools, and returns the first mismatch or error.
+func SelfTest() error {
+	for level := zlib.HuffmanOnly; level <= zlib.BestCompression; level++ {
+		deflated, err := AppendDeflateBytesLevel(nil, selfTestPayload, level)
+		if err != nil {
+			return fmt.Errorf("deflate level %d: %w", level, err)
+		}
+		if err = checkRoundTrip(deflated); err != nil {
+			return fmt.Errorf("level %d: %w", level, err)
+		}
+
+		var w selfTestWriter
+		if _, err = WriteDeflateLevel(&w, selfTestPayload, level); err != nil {
+			return fmt.Errorf("stackless deflate level %d: %w", level, err)
+		}
+		if err = checkRoundTrip(w.b); err != nil {
+			return fmt.Errorf("stackless level %d: %w", level, err)
+		}
+	}
+	return nil
+}
+
+func checkRoundTrip(deflated []byte) error {
+	inflated, err := AppendInflateBytes(nil, deflated)
+	if err != nil {
+		return fmt.Errorf("inflate: %w", err)
+	}
+	if !bytes.Equal(inflated, selfTestPayload) {
+		return fmt.Errorf("round trip mismatch: got %d bytes, expecting %d", len(inflated), len(selfTestPayload))
+	}
+	return nil
+}
+
+// selfTestWriter isn't one of the non-blocking writers known to WriteDeflateLevel,
+// so writes to it take the stackless path
+type selfTestWriter struct {
+	b []byte
+}
+
+func (w *selfTestWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
@@ -42,6 +42,14 @@
 package compress
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -96,9 +104,44 @@ func TestCompressAppendDeflateBytesLevel(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
+	// compress/flate output changes between Go versions, only the zlib
+	// header and the content are stable
+	if res1[0] != 120 || res1[1] != 94 {
+		t.Fatalf("Unexpected zlib header: %x. Expecting : 785e", res1[:2])
+	}
+	if inflated, err := AppendInflateBytes(nil, res1); err != nil || string(inflated) != string(src1) {
+		t.Fatalf("Unexpected : %s, %v. Expecting : %s", inflated, err, src1)
+	}
+}
+
+func TestCompressAppendDeflateBytesDeterministic(t *testing.T) {
 	expectedRes1 := []byte{120, 94, 202, 72, 205, 201, 201, 7, 4, 0, 0, 255, 255, 6, 44, 2, 21}
-	if string(res1) != string(expectedRes1) {
-		t.Fatalf("Unexpected : %s. Expecting : %s", res1, expectedRes1)
+	if res1 := AppendDeflateBytesDeterministic(nil, []byte("hello"), 5); string(res1) != string(expectedRes1) {
+		t.Fatalf("Unexpected : %v. Expecting : %v", res1, expectedRes1)
+	}
+
+	var w defaultByteWriter
+	if n, err := WriteDeflateDeterministic(&w, []byte("hello"), 5); err != nil || n != 5 || string(w.b) != string(expectedRes1) {
+		t.Fatalf("Unexpected : %v, %d, %v. Expecting : %v", w.b, n, err, expectedRes1)
+	}
+
+	src := []byte(strings.Repeat("hello, deterministic ", 5000) + "\xff\x00")
+	for _, level := range []int{zlib.HuffmanOnly, zlib.NoCompression, 1, 5, 6, 9} {
+		res := AppendDeflateBytesDeterministic([]byte("!!!"), src, level)
+		zr, err := zlib.NewReader(bytes.NewReader(res[3:]))
+		if err != nil {
+			t.Fatalf("Unexpected error for level %d: %s", level, err)
+		}
+		inflated, err := io.ReadAll(zr)
+		if err != nil || string(inflated) != string(src) {
+			t.Fatalf("Unexpected round trip for level %d: %v", level, err)
+		}
+		if level > 0 && len(res) > len(src)/10 {
+			t.Fatalf("Unexpected size %d for level %d", len(res), level)
+		}
+	}
+	if res := AppendDeflateBytesDeterministic(nil, nil, 6); string(res) != "\x78\x9c\x01\x00\x00\xff\xff\x00\x00\x00\x01" {
+		t.Fatalf("Unexpected empty stream: %x", res)
 	}
 }
 
@@ -106,10 +149,9 @@ func TestCompressWriteDeflateLevel(t *testing.T) {
 	// test default case for WriteDeflateLevel
 	var w defaultByteWriter
 	p := []byte("hello")
-	expectedW := []byte{120, 94, 202, 72, 205, 201, 201, 7, 4, 0, 0, 255, 255, 6, 44, 2, 21}
 	num, err := WriteDeflateLevel(&w, p, 5)
-	if string(expectedW) != string(w.b) {
-		t.Fatalf("Unexpected : %s. Expecting: %s.", w.b, expectedW)
+	if inflated, _ := AppendInflateBytes(nil, w.b); string(inflated) != string(p) {
+		t.Fatalf("Unexpected : %s. Expecting: %s.", inflated, p)
 	}
 	if num != len(p) {
 		t.Fatalf("Unexpected number of compressed bytes: %d", num)
@@ -119,6 +161,672 @@ func TestCompressWriteDeflateLevel(t *testing.T) {
 	}
 }
 
+func TestCompressAppendDeflateBytesLevelFlushed(t *testing.T) {
+	src := []byte(strings.Repeat("data: flushed event\n\n", 50))
+	flushAt := []int{0, 21, 21, 400, len(src)}
+	res, ends, err := AppendDeflateBytesLevelFlushed([]byte("prefix"), src, 6, flushAt)
+	if err != nil || len(ends) != len(flushAt) || string(res[:6]) != "prefix" {
+		t.Fatalf("Unexpected : %v, %v", ends, err)
+	}
+	for i, off := range flushAt {
+		zr, err := zlib.NewReader(bytes.NewReader(res[6:ends[i]]))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		part := make([]byte, off)
+		if _, err = io.ReadFull(zr, part); err != nil || !bytes.Equal(part, src[:off]) {
+			t.Fatalf("Unexpected : %q, %v. Expecting : %q", part, err, src[:off])
+		}
+	}
+	inflated, err := AppendInflateBytes(nil, res[6:])
+	if err != nil || !bytes.Equal(inflated, src) {
+		t.Fatalf("Unexpected : %v", err)
+	}
+
+	for _, flushAt := range [][]int{{-1}, {10, 5}, {len(src) + 1}} {
+		if _, _, err = AppendDeflateBytesLevelFlushed(nil, src, 6, flushAt); err == nil {
+			t.Fatalf("Expecting an error for offsets %v", flushAt)
+		}
+	}
+}
+
+func TestCompressAppendDeflateBytesLevelPadded(t *testing.T) {
+	src := []byte("hello")
+	unpadded, err := AppendDeflateBytesLevelPadded(nil, src, 5, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for padding := 0; padding <= 40; padding++ {
+		res, err := AppendDeflateBytesLevelPadded([]byte("!!!"), src, 5, padding)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(res)-3-len(unpadded) != PaddingSize(padding) {
+			t.Fatalf("Unexpected padding: %d. Expecting: %d", len(res)-3-len(unpadded), PaddingSize(padding))
+		}
+		inflated, err := AppendInflateBytes(nil, res[3:])
+		if err != nil {
+			t.Fatalf("Unexpected error for padding %d: %s", padding, err)
+		}
+		if string(inflated) != string(src) {
+			t.Fatalf("Unexpected : %s. Expecting : %s", inflated, src)
+		}
+	}
+}
+
+func TestCompressBlockPaddingSize(t *testing.T) {
+	src := []byte("hello")
+	for block := 1; block <= 64; block++ {
+		res, err := AppendDeflateBytesLevelPaddedFunc(nil, src, 5, func(n int) int {
+			return BlockPaddingSize(n, block)
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(res)%block != 0 {
+			t.Fatalf("Unexpected length %d for block %d", len(res), block)
+		}
+		inflated, err := AppendInflateBytes(nil, res)
+		if err != nil || string(inflated) != string(src) {
+			t.Fatalf("Unexpected : %s, %v. Expecting : %s", inflated, err, src)
+		}
+	}
+}
+
+func TestCompressPrewarmPools(t *testing.T) {
+	// sync.Pool may drop what is put into it, only check that prewarmed
+	// writers compress correctly on both paths
+	PrewarmPools(1, 2)
+	src := []byte(strings.Repeat("hello, prewarmed pools ", 100))
+	for i := 0; i < 3; i++ {
+		deflated, err := AppendDeflateBytesLevel(nil, src, 1)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		var w defaultByteWriter
+		if _, err = WriteDeflateLevel(&w, src, 1); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, b := range [][]byte{deflated, w.b} {
+			res, err := AppendInflateBytes(nil, b)
+			if err != nil || !bytes.Equal(res, src) {
+				t.Fatalf("Unexpected : %q, %v. Expecting : %q", res, err, src)
+			}
+		}
+	}
+}
+
+func TestCompressPools(t *testing.T) {
+	src := []byte(strings.Repeat("hello, pools ", 100))
+	pools := NewPools()
+	for _, level := range []int{-2, 0, 1, 6, 9, 42} {
+		res, err := pools.AppendDeflateBytesLevel([]byte("!!!"), src, level)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		inflated, err := pools.AppendInflateBytes(nil, res[3:])
+		if err != nil || string(inflated) != string(src) {
+			t.Fatalf("Unexpected : %s, %v. Expecting : %s", inflated, err, src)
+		}
+	}
+	// invalid levels are clamped as by the package functions
+	for level, clamped := range map[int]int{42: 9, -5: -2} {
+		res, _ := pools.AppendDeflateBytesLevel(nil, src, level)
+		expected, _ := AppendDeflateBytesLevel(nil, src, clamped)
+		if string(res) != string(expected) {
+			t.Fatalf("Unexpected deflate encoding for the invalid level %d", level)
+		}
+	}
+	// the writers are returned to the pools of the instance, not the global ones
+	nLevel := normalizeCompressLevel(1)
+	for realDeflateWriterPoolMap[nLevel].Get() != nil {
+		// drain the global pool
+	}
+	pools.AppendDeflateBytesLevel(nil, src, 1)
+	if pools.writerPoolMap[nLevel].Get() == nil {
+		t.Fatalf("Expecting a pooled deflate writer")
+	}
+	if realDeflateWriterPoolMap[nLevel].Get() != nil {
+		t.Fatalf("Unexpected deflate writer in the global pool")
+	}
+}
+
+func TestCompressDeflateSpooled(t *testing.T) {
+	src := []byte(strings.Repeat("hello, spooling ", 1000))
+	dir := t.TempDir()
+	for _, threshold := range []int{1 << 20, 16} {
+		r, n, err := DeflateSpooled(src, 6, threshold, dir)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		res, err := io.ReadAll(r)
+		if err != nil || int64(len(res)) != n {
+			t.Fatalf("Unexpected : %d bytes, %v. Expecting : %d bytes", len(res), err, n)
+		}
+		inflated, err := AppendInflateBytes(nil, res)
+		if err != nil || string(inflated) != string(src) {
+			t.Fatalf("Unexpected : %s, %v. Expecting : %s", inflated, err, src)
+		}
+		if err = r.Close(); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		// the temporary file is removed by Close
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Fatalf("Unexpected files left: %v", entries)
+		}
+	}
+
+	s := NewSpoolWriter(4, dir)
+	s.Write([]byte("abc"))
+	if s.Spilled() {
+		t.Fatalf("Unexpected spill below the threshold")
+	}
+	s.Write([]byte("def"))
+	if !s.Spilled() || s.Len() != 6 {
+		t.Fatalf("Unexpected : spilled %v, %d bytes. Expecting : spilled, 6 bytes", s.Spilled(), s.Len())
+	}
+	r, err := s.Reader()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if res, _ := io.ReadAll(r); string(res) != "abcdef" {
+		t.Fatalf("Unexpected : %s. Expecting : abcdef", res)
+	}
+	r.Close()
+}
+
+func TestCompressAppendInflateBytesLimit(t *testing.T) {
+	src := bytes.Repeat([]byte("a"), 1<<20)
+	deflated, _ := AppendDeflateBytesLevel(nil, src, 9)
+
+	res, err := AppendInflateBytesLimit(nil, deflated, InflateLimits{})
+	if err != nil || !bytes.Equal(res, src) {
+		t.Fatalf("Unexpected : %d bytes, %v. Expecting : %d bytes", len(res), err, len(src))
+	}
+	for _, limits := range []InflateLimits{{MaxSize: 1000}, {MaxRatio: 10}, DefaultInflateLimits} {
+		res, err = AppendInflateBytesLimit(nil, deflated, limits)
+		if err != ErrInflateLimit {
+			t.Fatalf("Unexpected error: %v. Expecting : %v", err, ErrInflateLimit)
+		}
+		if max := limits.max(len(deflated)); int64(len(res)) > max {
+			t.Fatalf("Unexpected : %d bytes. Expecting at most : %d bytes", len(res), max)
+		}
+	}
+
+	for _, p := range [][]byte{nil, {0x78}, {0x1f, 0x8b, 8, 0}, {0x78, 0x00}, {0x78, 0xbb, 0, 0, 0, 1}} {
+		if _, err = AppendInflateBytesLimit(nil, p, DefaultInflateLimits); err == nil {
+			t.Fatalf("Expecting an error for header %x", p)
+		}
+	}
+}
+
+func TestCompressInflateLimitGzipAndStream(t *testing.T) {
+	src := bytes.Repeat([]byte("a"), 1<<20)
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(src)
+	gw.Close()
+	deflated, _ := AppendDeflateBytesLevel(nil, src, 9)
+
+	res, err := AppendGunzipBytesLimit(nil, gz.Bytes(), InflateLimits{})
+	if err != nil || !bytes.Equal(res, src) {
+		t.Fatalf("Unexpected : %d bytes, %v. Expecting : %d bytes", len(res), err, len(src))
+	}
+	for _, limits := range []InflateLimits{{MaxSize: 1000}, {MaxRatio: 10}} {
+		res, err = AppendGunzipBytesLimit(nil, gz.Bytes(), limits)
+		if err != ErrInflateLimit || int64(len(res)) > limits.max(gz.Len()) {
+			t.Fatalf("Unexpected : %d bytes, %v. Expecting : %v", len(res), err, ErrInflateLimit)
+		}
+
+		zr, err := NewPooledInflateReadCloserLimit(bytes.NewReader(deflated), limits)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		res, err = io.ReadAll(zr)
+		zr.Close()
+		if err != ErrInflateLimit || int64(len(res)) > limits.max(len(deflated)) {
+			t.Fatalf("Unexpected : %d bytes, %v. Expecting : %v", len(res), err, ErrInflateLimit)
+		}
+	}
+
+	zr, _ := NewPooledInflateReadCloserLimit(bytes.NewReader(deflated), InflateLimits{MaxSize: int64(len(src))})
+	res, err = io.ReadAll(zr)
+	zr.Close()
+	if err != nil || !bytes.Equal(res, src) {
+		t.Fatalf("Unexpected : %d bytes, %v. Expecting : %d bytes", len(res), err, len(src))
+	}
+}
+
+func FuzzAppendInflateBytes(f *testing.F) {
+	for _, level := range []int{0, 1, 6, 9} {
+		deflated, _ := AppendDeflateBytesLevel(nil, []byte("hello, fuzzing hello, fuzzing"), level)
+		f.Add(deflated)
+	}
+	f.Add([]byte{0x78, 0x9c})
+	f.Fuzz(func(t *testing.T, p []byte) {
+		limits := InflateLimits{MaxSize: 1 << 20, MaxRatio: 100}
+		res, err := AppendInflateBytesLimit(nil, p, limits)
+		if int64(len(res)) > limits.max(len(p)) {
+			t.Fatalf("Unexpected : %d bytes beyond the limit %d", len(res), limits.max(len(p)))
+		}
+		if err != nil {
+			return
+		}
+		// a stream inflated within the limits inflates the same without them
+		unlimited, err := AppendInflateBytes(nil, p)
+		if err != nil || !bytes.Equal(res, unlimited) {
+			t.Fatalf("Unexpected : %d bytes, %v. Expecting : %d bytes", len(unlimited), err, len(res))
+		}
+	})
+}
+
+func FuzzWriteInflate(f *testing.F) {
+	deflated, _ := AppendDeflateBytesLevel(nil, []byte("hello, fuzzing"), 6)
+	f.Add(deflated)
+	f.Fuzz(func(t *testing.T, p []byte) {
+		var buf bytes.Buffer
+		n, err := WriteInflate(&buf, p)
+		if err == nil && n != buf.Len() {
+			t.Fatalf("Unexpected : %d bytes reported, %d written", n, buf.Len())
+		}
+	})
+}
+
+func TestCompressTranscodeGzipToDeflate(t *testing.T) {
+	src := []byte(strings.Repeat("hello, transcoding ", 100))
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(src)
+	gw.Close()
+
+	res, err := TranscodeGzipToDeflate([]byte("!!!"), gzipped.Bytes(), 5)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	inflated, err := AppendInflateBytes(nil, res[3:])
+	if err != nil || string(inflated) != string(src) {
+		t.Fatalf("Unexpected : %s, %v. Expecting : %s", inflated, err, src)
+	}
+	// nothing follows the zlib trailer
+	zr, _ := zlib.NewReader(bytes.NewReader(res[3:]))
+	io.Copy(io.Discard, zr)
+	zr.Close()
+	expected, _ := AppendDeflateBytesLevel(nil, src, 5)
+	if len(res[3:]) != len(expected) {
+		t.Fatalf("Unexpected : %d bytes. Expecting : %d bytes", len(res[3:]), len(expected))
+	}
+	if _, err = AppendInflateConcatenatedBytes(nil, res[3:]); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var w bytes.Buffer
+	n, err := WriteTranscodeGzipToDeflate(&w, bytes.NewReader(gzipped.Bytes()), 5)
+	if err != nil || n != int64(len(src)) {
+		t.Fatalf("Unexpected : %d, %v. Expecting : %d", n, err, len(src))
+	}
+	if !bytes.Equal(w.Bytes(), res[3:]) {
+		t.Fatalf("Unexpected streaming result: %x. Expecting : %x", w.Bytes(), res[3:])
+	}
+
+	if _, err = TranscodeGzipToDeflate(nil, src, 5); err == nil {
+		t.Fatalf("Expecting an error for a body which is not gzipped")
+	}
+}
+
+func TestCompressNewDeflateReader(t *testing.T) {
+	src := []byte(strings.Repeat("hello, streaming ", 10000))
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < len(src); i += 1000 {
+			pw.Write(src[i:min(i+1000, len(src))])
+		}
+		pw.Close()
+	}()
+	r := NewDeflateReader(pr, 5)
+	res, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err = r.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	inflated, err := AppendInflateBytes(nil, res)
+	if err != nil || string(inflated) != string(src) {
+		t.Fatalf("Unexpected : %d bytes, %v. Expecting : %d bytes", len(inflated), err, len(src))
+	}
+}
+
+// pullRecorder records the largest read of its Reader and the bytes read so far
+type pullRecorder struct {
+	io.Reader
+	pulled, largest int
+}
+
+func (r *pullRecorder) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.pulled += n
+	r.largest = max(r.largest, n)
+	return n, err
+}
+
+func TestCompressNewDeflateReaderSize(t *testing.T) {
+	src := []byte(strings.Repeat("backpressure ", 10000))
+	body := &pullRecorder{Reader: bytes.NewReader(src)}
+	r := NewDeflateReaderSize(body, 6, 1024)
+
+	// nothing more is pulled until the output of the first read is consumed
+	res := make([]byte, 2)
+	for i := range res {
+		if _, err := r.Read(res[i : i+1]); err != nil || body.pulled != 1024 {
+			t.Fatalf("Unexpected : %d bytes pulled, %v. Expecting : 1024", body.pulled, err)
+		}
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil || body.largest != 1024 {
+		t.Fatalf("Unexpected : largest read %d, %v. Expecting : 1024", body.largest, err)
+	}
+	r.Close()
+	inflated, err := AppendInflateBytes(nil, append(res, rest...))
+	if err != nil || !bytes.Equal(inflated, src) {
+		t.Fatalf("Unexpected : %d bytes, %v. Expecting : %d bytes", len(inflated), err, len(src))
+	}
+}
+
+func TestCompressSelfTest(t *testing.T) {
+	if err := SelfTest(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func TestCompressDetectEncoding(t *testing.T) {
+	deflated, _ := AppendDeflateBytesLevel(nil, []byte("hello"), 9)
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte("hello"))
+	gw.Close()
+	for _, tc := range []struct {
+		p        []byte
+		expected string
+	}{
+		{deflated, EncodingDeflate},
+		{[]byte{0x78, 0x01}, EncodingDeflate},
+		{[]byte{0x78, 0x02}, ""},
+		{gzipped.Bytes(), EncodingGzip},
+		{[]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, EncodingZstd},
+		{[]byte{0xce, 0xb2, 0xcf, 0x81, 0x00}, EncodingBrotli},
+		{[]byte("hello"), ""},
+		{nil, ""},
+	} {
+		if res := DetectEncoding(tc.p); res != tc.expected {
+			t.Fatalf("Unexpected encoding %q for %x. Expecting %q", res, tc.p, tc.expected)
+		}
+	}
+}
+
+func TestCompressAppendInflateConcatenatedBytes(t *testing.T) {
+	first, _ := AppendDeflateBytesLevel(nil, []byte("hello, "), 5)
+	src, _ := AppendDeflateBytesLevel(first, []byte(strings.Repeat("world", 100)), 9)
+
+	res, err := AppendInflateConcatenatedBytes([]byte("!"), src)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if expected := "!hello, " + strings.Repeat("world", 100); string(res) != expected {
+		t.Fatalf("Unexpected : %s. Expecting : %s", res, expected)
+	}
+
+	res, err = AppendInflateBytes(nil, src)
+	if err != nil || string(res) != "hello, " {
+		t.Fatalf("Unexpected : %s, %v. Expecting : hello, ", res, err)
+	}
+
+	if _, err = AppendInflateConcatenatedBytes(nil, append(src, 0x78)); err == nil {
+		t.Fatalf("Expecting an error for a truncated member")
+	}
+}
+
+func TestCompressDictionary(t *testing.T) {
+	dict := NewDictionary([]byte("hello, world"))
+	other := NewDictionary([]byte("goodbye, world"))
+	src := []byte(strings.Repeat("hello, world", 10))
+
+	for _, level := range []int{1, 6, 9, 6} {
+		compressed, err := dict.AppendDeflateBytesLevel(nil, src, level)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		res, err := dict.AppendInflateBytes(nil, compressed)
+		if err != nil || string(res) != string(src) {
+			t.Fatalf("Unexpected : %s, %v. Expecting : %s", res, err, src)
+		}
+		if _, err = other.AppendInflateBytes(nil, compressed); err == nil {
+			t.Fatalf("Expecting an error when inflating with another dictionary")
+		}
+		if _, err = AppendInflateBytes(nil, compressed); err == nil {
+			t.Fatalf("Expecting an error when inflating without the dictionary")
+		}
+	}
+
+	// invalid levels are clamped as for the level-only pools
+	clamped, _ := NewDictionary([]byte("hello, world")).AppendDeflateBytesLevel(nil, src, 9)
+	if compressed, _ := dict.AppendDeflateBytesLevel(nil, src, 42); string(compressed) != string(clamped) {
+		t.Fatalf("Unexpected deflate encoding for an invalid level")
+	}
+
+	// the level-only pools must not hand out writers reset with the dictionary
+	compressed, _ := AppendDeflateBytesLevel(nil, src, 6)
+	if res, err := AppendInflateBytes(nil, compressed); err != nil || string(res) != string(src) {
+		t.Fatalf("Unexpected : %s, %v. Expecting : %s", res, err, src)
+	}
+	if dict.ID() == other.ID() {
+		t.Fatalf("Expecting distinct dictionary ids")
+	}
+}
+
+func TestCompressStacklessDeflateWriterFlush(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewStacklessDeflateWriter(&buf, zlib.BestSpeed)
+	if _, err := w.Write([]byte("first event\n")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	p := make([]byte, 64)
+	n, _ := io.ReadAtLeast(zr, p, len("first event\n"))
+	if string(p[:n]) != "first event\n" {
+		t.Fatalf("Unexpected flushed data: %q. Expecting : %q", p[:n], "first event\n")
+	}
+
+	w.Write([]byte("second event\n"))
+	if err = w.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err = w.Write([]byte("late")); err == nil {
+		t.Fatalf("Expecting an error when writing to a closed writer")
+	}
+	res, err := AppendInflateConcatenatedBytes(nil, buf.Bytes())
+	if err != nil || string(res) != "first event\nsecond event\n" {
+		t.Fatalf("Unexpected : %q, %v", res, err)
+	}
+}
+
+func TestCompressWriteInflateReader(t *testing.T) {
+	const size = 8 << 20
+	compressed, _ := AppendDeflateBytesLevel(nil, make([]byte, size), 9)
+
+	n, err := WriteInflateReader(io.Discard, bytes.NewReader(compressed))
+	if err != nil || n != size {
+		t.Fatalf("Unexpected : %d, %v. Expecting : %d", n, err, size)
+	}
+	n, err = WriteInflate64(io.Discard, compressed)
+	if err != nil || n != size {
+		t.Fatalf("Unexpected : %d, %v. Expecting : %d", n, err, size)
+	}
+	if _, err = WriteInflateReader(io.Discard, strings.NewReader("not deflate")); err == nil {
+		t.Fatalf("Expecting an error for a body which is not deflated")
+	}
+}
+
+func TestCompressParallelDeflateWriter(t *testing.T) {
+	src := []byte(strings.Repeat("hello, parallel blocks ", 20000))
+	for _, blockSize := range []int{1000, 64 << 10, len(src)} {
+		var buf bytes.Buffer
+		zw := NewParallelDeflateWriter(&buf, 6, blockSize, 4)
+		for p := src; len(p) > 0; {
+			n := min(len(p), 777)
+			if _, err := zw.Write(p[:n]); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			p = p[n:]
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		zr, err := zlib.NewReader(&buf)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if res, err := io.ReadAll(zr); err != nil || string(res) != string(src) {
+			t.Fatalf("Unexpected round trip for block size %d: %v", blockSize, err)
+		}
+		if _, err = zw.Write(src); err == nil {
+			t.Fatalf("Expecting an error when writing to a closed writer")
+		}
+	}
+
+	r := NewParallelDeflateReader(bytes.NewReader(src), 6)
+	compressed, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if res, err := AppendInflateBytes(nil, compressed); err != nil || string(res) != string(src) {
+		t.Fatalf("Unexpected round trip: %v", err)
+	}
+}
+
+func TestCompressVerifyZlibChecksum(t *testing.T) {
+	src, _ := AppendDeflateBytesLevel(nil, []byte(strings.Repeat("checksum ", 1000)), 6)
+	if err := VerifyZlibChecksum(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	corrupted := append([]byte(nil), src...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	if err := VerifyZlibChecksum(corrupted); err != zlib.ErrChecksum {
+		t.Fatalf("Unexpected error: %v. Expecting : %v", err, zlib.ErrChecksum)
+	}
+	if err := VerifyZlibChecksum(src[:len(src)-2]); err == nil {
+		t.Fatalf("Expecting an error for a truncated stream")
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestCompressNewPooledInflateReadCloser(t *testing.T) {
+	src := strings.Repeat("pooled inflate ", 1000)
+	compressed, _ := AppendDeflateBytesLevel(nil, []byte(src), 6)
+
+	body := &closeRecorder{Reader: bytes.NewReader(compressed)}
+	r, err := NewPooledInflateReadCloser(body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	res, err := io.ReadAll(r)
+	if err != nil || string(res) != src {
+		t.Fatalf("Unexpected : %v", err)
+	}
+	if r.(*pooledInflateReader).zr != nil {
+		t.Fatalf("Expecting the zlib reader to be released at EOF")
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("Unexpected : %d, %v. Expecting : 0, EOF", n, err)
+	}
+	if err = r.Close(); err != nil || !body.closed {
+		t.Fatalf("Unexpected : %v, %v. Expecting the body to be closed", err, body.closed)
+	}
+
+	r, _ = NewPooledInflateReadCloser(bytes.NewReader(compressed))
+	r.Read(make([]byte, 10))
+	r.Close()
+	if _, err = r.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Fatalf("Unexpected error: %v. Expecting : %v", err, io.ErrClosedPipe)
+	}
+
+	if _, err = NewPooledInflateReadCloser(strings.NewReader("not zlib")); err == nil {
+		t.Fatalf("Expecting an error for a stream which is not zlib")
+	}
+}
+
+func TestCompressCopyFastPaths(t *testing.T) {
+	src := strings.Repeat("copy fast paths ", 5000)
+
+	var compressed bytes.Buffer
+	w := NewStacklessDeflateWriter(&compressed, 6)
+	var _ io.ReaderFrom = w
+	n, err := io.Copy(w, strings.NewReader(src))
+	if err != nil || n != int64(len(src)) {
+		t.Fatalf("Unexpected : %d, %v. Expecting : %d", n, err, len(src))
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err = w.ReadFrom(strings.NewReader(src)); err != io.ErrClosedPipe {
+		t.Fatalf("Unexpected error: %v. Expecting : %v", err, io.ErrClosedPipe)
+	}
+
+	r, err := NewPooledInflateReadCloser(&compressed)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := r.(io.WriterTo); !ok {
+		t.Fatalf("Expecting the inflating reader to implement io.WriterTo")
+	}
+	var res bytes.Buffer
+	n, err = io.Copy(&res, r)
+	if err != nil || n != int64(len(src)) || res.String() != src {
+		t.Fatalf("Unexpected : %d, %v. Expecting : %d", n, err, len(src))
+	}
+	if r.(*pooledInflateReader).zr != nil {
+		t.Fatalf("Expecting the zlib reader to be released at EOF")
+	}
+	r.Close()
+}
+
+func TestCompressShardedFunc(t *testing.T) {
+	src := []byte(strings.Repeat("sharded ", 100))
+	s := newShardedFunc(nonblockingWriteDeflate, 4)
+	// an overloaded shard falls back to the caller's stack
+	s.shards[0] = func(ctx interface{}) bool { return false }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var w bytes.Buffer
+			s.call(&compressCtx{w: &w, p: src, level: CompressDefaultCompression})
+			res, err := AppendInflateBytes(nil, w.Bytes())
+			if err != nil || !bytes.Equal(res, src) {
+				t.Errorf("Unexpected : %q, %v", res, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 type defaultByteWriter struct {
 	b []byte
 }
@@ -127,3 +835,119 @@ func (w *defaultByteWriter) Write(p []byte) (int, error) {
 	w.b = append(w.b, p...)
 	return len(p), nil
 }
+
+var benchmarkLevels = []int{1, 6, 9}
+
+var benchmarkSizes = []int{1 << 10, 16 << 10, 256 << 10}
+
+// loadBenchmarkCorpus returns the testdata file repeated or truncated to size bytes
+func loadBenchmarkCorpus(b *testing.B, name string, size int) []byte {
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		b.Fatalf("Unexpected error: %s", err)
+	}
+	for len(data) < size {
+		data = append(data, data...)
+	}
+	return data[:size]
+}
+
+func BenchmarkAppendDeflateBytesLevel(b *testing.B) {
+	for _, name := range []string{"sample.json", "sample.html"} {
+		for _, size := range benchmarkSizes {
+			src := loadBenchmarkCorpus(b, name, size)
+			for _, level := range benchmarkLevels {
+				b.Run(fmt.Sprintf("%s/%dKB/level%d", name, size>>10, level), func(b *testing.B) {
+					var dst []byte
+					b.SetBytes(int64(len(src)))
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						dst, _ = AppendDeflateBytesLevel(dst[:0], src, level)
+					}
+					b.ReportMetric(float64(len(dst))/float64(len(src)), "ratio")
+				})
+			}
+		}
+	}
+}
+
+func BenchmarkWriteDeflateLevel(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		src := loadBenchmarkCorpus(b, "sample.json", size)
+		b.Run(fmt.Sprintf("stackless/%dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var w defaultByteWriter
+				_, _ = WriteDeflateLevel(&w, src, CompressDefaultCompression)
+			}
+		})
+		b.Run(fmt.Sprintf("nonblocking/%dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var w bytes.Buffer
+				_, _ = WriteDeflateLevel(&w, src, CompressDefaultCompression)
+			}
+		})
+		b.Run(fmt.Sprintf("direct/%dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				zw, _ := zlib.NewWriterLevel(io.Discard, CompressDefaultCompression)
+				_, _ = zw.Write(src)
+				_ = zw.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkAppendInflateBytes(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		src, _ := AppendDeflateBytesLevel(nil, loadBenchmarkCorpus(b, "sample.json", size), CompressDefaultCompression)
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			var dst []byte
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				dst, _ = AppendInflateBytes(dst[:0], src)
+			}
+		})
+	}
+}
+
+func BenchmarkWriteInflate(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		src, _ := AppendDeflateBytesLevel(nil, loadBenchmarkCorpus(b, "sample.json", size), CompressDefaultCompression)
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var w defaultByteWriter
+				_, _ = WriteInflate(&w, src)
+			}
+		})
+	}
+}
+
+func BenchmarkStacklessWriteDeflateParallel(b *testing.B) {
+	src := loadBenchmarkCorpus(b, "sample.json", 1<<10)
+	for _, shards := range []int{1, maxStacklessShards} {
+		f := newShardedFunc(nonblockingWriteDeflate, shards)
+		b.Run(fmt.Sprintf("shards%d", shards), func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				var w bytes.Buffer
+				for pb.Next() {
+					w.Reset()
+					ctx := compressCtxPool.Get().(*compressCtx)
+					ctx.w, ctx.p, ctx.level = &w, src, CompressDefaultCompression
+					f.call(ctx)
+					*ctx = compressCtx{}
+					compressCtxPool.Put(ctx)
+				}
+			})
+		})
+	}
+}
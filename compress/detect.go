@@ -0,0 +1,45 @@
+package compress
+
+import "bytes"
+
+// Content codings returned by DetectEncoding
+const (
+	EncodingDeflate = "deflate"
+	EncodingGzip    = "gzip"
+	EncodingZstd    = "zstd"
+	EncodingBrotli  = "br"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b, 0x08}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	// brotliFramingMagic starts the brotli framing format, plain brotli
+	// streams have no signature and can't be detected
+	brotliFramingMagic = []byte{0xce, 0xb2, 0xcf, 0x81}
+)
+
+// DetectEncoding returns the content coding whose signature starts p: deflate
+// for a zlib header, gzip, zstd or br, or "" when none matches.
+func DetectEncoding(p []byte) string {
+	switch {
+	case bytes.HasPrefix(p, gzipMagic):
+		return EncodingGzip
+	case bytes.HasPrefix(p, zstdMagic):
+		return EncodingZstd
+	case bytes.HasPrefix(p, brotliFramingMagic):
+		return EncodingBrotli
+	case isZlibHeader(p):
+		return EncodingDeflate
+	}
+	return ""
+}
+
+// isZlibHeader checks the RFC 1950 header: deflate method, a window of at most
+// 32K and the FCHECK bits making the header a multiple of 31
+func isZlibHeader(p []byte) bool {
+	if len(p) < 2 {
+		return false
+	}
+	cmf, flg := p[0], p[1]
+	return cmf&0x0f == 8 && cmf>>4 <= 7 && (uint16(cmf)<<8|uint16(flg))%31 == 0
+}
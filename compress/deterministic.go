@@ -0,0 +1,205 @@
+package compress
+
+import (
+	"compress/zlib"
+	"encoding/binary"
+	"hash/adler32"
+	"io"
+)
+
+// The deterministic encoder doesn't depend on compress/flate, whose output
+// changes between Go versions: the bytes it produces only depend on the input
+// and the level, so they can be used as cache keys or golden test fixtures.
+//
+// Levels other than NoCompression and HuffmanOnly share the same greedy
+// matching and the fixed Huffman codes, the level only sets the FLEVEL bits of
+// the zlib header. The data is written in a single block,
+// followed by an empty final stored block.
+
+const (
+	detWindowSize = 1 << 15
+	detHashBits   = 15
+	detMinMatch   = 3
+	detMaxMatch   = 258
+	detMaxStored  = 0xffff
+)
+
+var (
+	detLengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	detLengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	detDistBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	detDistExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+)
+
+// AppendDeflateBytesDeterministic appends the zlib encoding of src to dst and
+// returns the resulting dst. Unlike AppendDeflateBytesLevel, the output is the
+// same across Go versions and platforms.
+func AppendDeflateBytesDeterministic(dst, src []byte, level int) []byte {
+	dst = appendZlibHeader(dst, level)
+	bw := &detBitWriter{b: dst}
+	switch level {
+	case zlib.NoCompression:
+		for p := src; len(p) > 0; {
+			n := min(len(p), detMaxStored)
+			bw.writeStored(p[:n], false)
+			p = p[n:]
+		}
+	default:
+		if len(src) > 0 {
+			// BFINAL=0, BTYPE=01: fixed Huffman codes
+			bw.writeBits(0b010, 3)
+			if level == zlib.HuffmanOnly {
+				for _, c := range src {
+					bw.writeLiteral(c)
+				}
+			} else {
+				bw.writeMatches(src)
+			}
+			bw.writeCode(256)
+		}
+	}
+	bw.writeStored(nil, true)
+	return binary.BigEndian.AppendUint32(bw.b, adler32.Checksum(src))
+}
+
+// WriteDeflateDeterministic writes the deterministic zlib encoding of p to w,
+// see AppendDeflateBytesDeterministic, and returns the number of uncompressed
+// bytes written.
+func WriteDeflateDeterministic(w io.Writer, p []byte, level int) (int, error) {
+	if _, err := w.Write(AppendDeflateBytesDeterministic(nil, p, level)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// appendZlibHeader appends the zlib header written by compress/zlib for level
+func appendZlibHeader(dst []byte, level int) []byte {
+	const cmf = 0x78 // deflate, 32K window
+	var flevel byte
+	switch level {
+	case zlib.HuffmanOnly, zlib.NoCompression, zlib.BestSpeed:
+		flevel = 0
+	case 2, 3, 4, 5:
+		flevel = 1
+	case 7, 8, 9:
+		flevel = 3
+	default:
+		flevel = 2
+	}
+	flg := flevel << 6
+	flg += 31 - byte((uint16(cmf)<<8|uint16(flg))%31)
+	return append(dst, cmf, flg)
+}
+
+type detBitWriter struct {
+	b     []byte
+	bits  uint64
+	nbits uint
+}
+
+func (w *detBitWriter) writeBits(v uint64, n uint) {
+	w.bits |= v << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.b = append(w.b, byte(w.bits))
+		w.bits >>= 8
+		w.nbits -= 8
+	}
+}
+
+// writeHuffman writes the n bits Huffman code, which are packed starting with
+// the most significant bit
+func (w *detBitWriter) writeHuffman(code uint16, n uint) {
+	var rev uint64
+	for i := uint(0); i < n; i++ {
+		rev = rev<<1 | uint64(code>>i&1)
+	}
+	w.writeBits(rev, n)
+}
+
+// writeCode writes the fixed Huffman code of the literal/length symbol
+func (w *detBitWriter) writeCode(sym int) {
+	switch {
+	case sym < 144:
+		w.writeHuffman(uint16(0x30+sym), 8)
+	case sym < 256:
+		w.writeHuffman(uint16(0x190+sym-144), 9)
+	case sym < 280:
+		w.writeHuffman(uint16(sym-256), 7)
+	default:
+		w.writeHuffman(uint16(0xc0+sym-280), 8)
+	}
+}
+
+func (w *detBitWriter) writeLiteral(c byte) {
+	w.writeCode(int(c))
+}
+
+func (w *detBitWriter) writeMatch(length, dist int) {
+	i := 28
+	for int(detLengthBase[i]) > length {
+		i--
+	}
+	w.writeCode(257 + i)
+	w.writeBits(uint64(length-int(detLengthBase[i])), uint(detLengthExtra[i]))
+
+	j := 29
+	for int(detDistBase[j]) > dist {
+		j--
+	}
+	w.writeHuffman(uint16(j), 5)
+	w.writeBits(uint64(dist-int(detDistBase[j])), uint(detDistExtra[j]))
+}
+
+// writeMatches greedily replaces repeated sequences of src by back references
+// to their last occurrence
+func (w *detBitWriter) writeMatches(src []byte) {
+	var head [1 << detHashBits]int32
+	hash := func(i int) uint32 {
+		v := uint32(src[i]) | uint32(src[i+1])<<8 | uint32(src[i+2])<<16
+		return (v * 0x1e35a7bd) >> (32 - detHashBits)
+	}
+	for i := 0; i < len(src); {
+		if i+detMinMatch > len(src) {
+			w.writeLiteral(src[i])
+			i++
+			continue
+		}
+		h := hash(i)
+		// head holds the position + 1, so 0 means none
+		candidate := int(head[h]) - 1
+		head[h] = int32(i + 1)
+		length := 0
+		if candidate >= 0 && i-candidate <= detWindowSize {
+			limit := min(len(src)-i, detMaxMatch)
+			for length < limit && src[candidate+length] == src[i+length] {
+				length++
+			}
+		}
+		if length < detMinMatch {
+			w.writeLiteral(src[i])
+			i++
+			continue
+		}
+		w.writeMatch(length, i-candidate)
+		for k := i + 1; k < i+length && k+detMinMatch <= len(src); k++ {
+			head[hash(k)] = int32(k + 1)
+		}
+		i += length
+	}
+}
+
+// writeStored writes a stored block holding p, at most detMaxStored bytes
+func (w *detBitWriter) writeStored(p []byte, final bool) {
+	var bfinal uint64
+	if final {
+		bfinal = 1
+	}
+	w.writeBits(bfinal, 3)
+	if w.nbits > 0 {
+		w.writeBits(0, 8-w.nbits)
+	}
+	n := uint16(len(p))
+	w.b = append(w.b, byte(n), byte(n>>8), byte(^n), byte(^n>>8))
+	w.b = append(w.b, p...)
+}
@@ -0,0 +1,92 @@
+package compress
+
+import (
+	"compress/zlib"
+	"hash/adler32"
+	"io"
+	"sync"
+)
+
+// Dictionary is a preset deflate dictionary. Writers reset with a dictionary
+// can't be shared with the level-only pools, so each Dictionary keeps its own
+// writer pools per level and its own reader pool: a dictionary has to be
+// created once and reused to benefit from pooling.
+type Dictionary struct {
+	b  []byte
+	id uint32
+
+	writerPoolMap []*sync.Pool
+	readerPool    sync.Pool
+}
+
+// NewDictionary returns the Dictionary holding b, which must not be modified afterwards
+func NewDictionary(b []byte) *Dictionary {
+	return &Dictionary{
+		b:             b,
+		id:            adler32.Checksum(b),
+		writerPoolMap: newCompressWriterPoolMap(),
+	}
+}
+
+// ID returns the Adler-32 checksum of the dictionary, the DICTID of the zlib
+// header of the streams compressed with it
+func (d *Dictionary) ID() uint32 {
+	return d.id
+}
+
+// Bytes returns the dictionary content
+func (d *Dictionary) Bytes() []byte {
+	return d.b
+}
+
+// AppendDeflateBytesLevel appends src deflated with the dictionary to dst using
+// the given compression level and returns the resulting dst.
+func (d *Dictionary) AppendDeflateBytesLevel(dst, src []byte, level int) ([]byte, error) {
+	w := &byteSliceWriter{dst}
+	zw := d.acquireWriter(w, level)
+	_, err := zw.Write(src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	d.releaseWriter(zw, level)
+	return w.b, err
+}
+
+// AppendInflateBytes appends src inflated with the dictionary to dst and
+// returns the resulting dst.
+func (d *Dictionary) AppendInflateBytes(dst, src []byte) ([]byte, error) {
+	w := &byteSliceWriter{dst}
+	r := &byteSliceReader{src}
+	var zr io.ReadCloser
+	if v := d.readerPool.Get(); v != nil {
+		zr = v.(io.ReadCloser)
+		if err := zr.(zlib.Resetter).Reset(r, d.b); err != nil {
+			return dst, err
+		}
+	} else {
+		var err error
+		if zr, err = zlib.NewReaderDict(r, d.b); err != nil {
+			return dst, err
+		}
+	}
+	_, err := io.Copy(w, zr)
+	zr.Close()
+	d.readerPool.Put(zr)
+	return w.b, err
+}
+
+func (d *Dictionary) acquireWriter(w io.Writer, level int) *zlib.Writer {
+	p := d.writerPoolMap[normalizeCompressLevel(level)]
+	if v := p.Get(); v != nil {
+		zw := v.(*zlib.Writer)
+		zw.Reset(w)
+		return zw
+	}
+	// invalid levels are clamped as for the level-only pools
+	zw, _ := zlib.NewWriterLevelDict(w, clampCompressLevel(level), d.b)
+	return zw
+}
+
+func (d *Dictionary) releaseWriter(zw *zlib.Writer, level int) {
+	d.writerPoolMap[normalizeCompressLevel(level)].Put(zw)
+}
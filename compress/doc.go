@@ -20,5 +20,16 @@
 // Thanks for fasthttp authors! Below is the source code information:
 // 		Repo: github.com/valyala/fasthttp
 //		Forked Version: v1.55.0
+//
+// The writers are built on compress/zlib of the standard library, which has no
+// window size or memory level setting, and there is no zstd, brotli or cgo
+// backend: besides the level, compression can only be tuned with a preset
+// Dictionary.
+//
+// Pooled writers don't grow with the data they compress: a compress/flate
+// writer allocates state of a fixed size for its level, and the buffer where a
+// stackless writer collects its output goes back to a bytebufferpool after
+// every call. Large responses thus leave no oversized writer in the pools, and
+// there is no limit to set on the size of pooled writers.
 
 package compress
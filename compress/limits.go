@@ -0,0 +1,168 @@
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+)
+
+// ErrInflateLimit is returned when inflating data would exceed its InflateLimits
+var ErrInflateLimit = errors.New("compress: inflated data exceeds the limit")
+
+// InflateLimits bounds the output of inflating untrusted data, so that a small
+// body can't expand into an arbitrarily large allocation. Zero fields set no
+// limit.
+type InflateLimits struct {
+	// MaxSize is the maximum size of the inflated data
+	MaxSize int64
+	// MaxRatio is the maximum ratio of the inflated size to the compressed one
+	MaxRatio int64
+}
+
+// DefaultInflateLimits are limits suited to request bodies: 64 MiB at most,
+// with a ratio of 1000 which legitimate payloads rarely reach.
+var DefaultInflateLimits = InflateLimits{MaxSize: 64 << 20, MaxRatio: 1000}
+
+// max returns the maximum inflated size of n compressed bytes, -1 for none
+func (l InflateLimits) max(n int) int64 {
+	m := int64(-1)
+	if l.MaxSize > 0 {
+		m = l.MaxSize
+	}
+	if l.MaxRatio > 0 && (m < 0 || l.MaxRatio*int64(n) < m) {
+		m = l.MaxRatio * int64(n)
+	}
+	return m
+}
+
+// AppendInflateBytesLimit is like AppendInflateBytes, but fails with
+// ErrInflateLimit once the inflated data exceeds limits.
+func AppendInflateBytesLimit(dst, src []byte, limits InflateLimits) ([]byte, error) {
+	w := &byteSliceWriter{dst}
+	_, err := WriteInflateLimit(w, src, limits)
+	return w.b, err
+}
+
+// WriteInflateLimit is like WriteInflate64, but fails with ErrInflateLimit once
+// the inflated data exceeds limits. The zlib header of p is checked before any
+// inflater is set up.
+func WriteInflateLimit(w io.Writer, p []byte, limits InflateLimits) (int64, error) {
+	if err := checkZlibHeader(p); err != nil {
+		return 0, err
+	}
+	if m := limits.max(len(p)); m >= 0 {
+		w = &limitedWriter{w: w, n: m}
+	}
+	return WriteInflate64(w, p)
+}
+
+// AppendGunzipBytesLimit appends the inflated gzip stream src to dst, failing
+// with ErrInflateLimit once the inflated data exceeds limits.
+func AppendGunzipBytesLimit(dst, src []byte, limits InflateLimits) ([]byte, error) {
+	zr, err := gzip.NewReader(&byteSliceReader{src})
+	if err != nil {
+		return dst, err
+	}
+	bw := &byteSliceWriter{dst}
+	var w io.Writer = bw
+	if m := limits.max(len(src)); m >= 0 {
+		w = &limitedWriter{w: w, n: m}
+	}
+	_, err = io.Copy(w, zr)
+	return bw.b, err
+}
+
+// NewPooledInflateReadCloserLimit is like NewPooledInflateReadCloser, but its
+// reads fail with ErrInflateLimit once the inflated data exceeds limits, the
+// ratio being that to the compressed bytes read from r so far.
+func NewPooledInflateReadCloserLimit(r io.Reader, limits InflateLimits) (io.ReadCloser, error) {
+	src := &countingReader{r: r}
+	zr, err := NewPooledInflateReadCloser(src)
+	if err != nil {
+		return nil, err
+	}
+	if limits.MaxSize <= 0 && limits.MaxRatio <= 0 {
+		return zr, nil
+	}
+	return &limitedReadCloser{ReadCloser: zr, src: src, limits: limits}, nil
+}
+
+// checkZlibHeader rejects p unless it starts with the header of a zlib stream
+// using deflate without a preset dictionary
+func checkZlibHeader(p []byte) error {
+	if len(p) < 2 {
+		return io.ErrUnexpectedEOF
+	}
+	cmf, flg := p[0], p[1]
+	if cmf&0x0f != 8 || cmf>>4 > 7 || (uint16(cmf)<<8|uint16(flg))%31 != 0 {
+		return zlib.ErrHeader
+	}
+	if flg&0x20 != 0 {
+		return zlib.ErrDictionary
+	}
+	return nil
+}
+
+// limitedWriter fails with ErrInflateLimit once more than n bytes are written
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		n, err := l.w.Write(p[:l.n])
+		l.n -= int64(n)
+		if err == nil {
+			err = ErrInflateLimit
+		}
+		return n, err
+	}
+	n, err := l.w.Write(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read from r, and closes r if it is an io.Closer
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	if cl, ok := c.r.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+// limitedReadCloser fails with ErrInflateLimit once more is read than limits
+// allow for the bytes read from src
+type limitedReadCloser struct {
+	io.ReadCloser
+	src    *countingReader
+	limits InflateLimits
+	n      int64
+	err    error
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.n += int64(n)
+	if m := l.limits.max(int(l.src.n)); m >= 0 && l.n > m {
+		n -= int(l.n - m)
+		l.err = ErrInflateLimit
+		return n, l.err
+	}
+	return n, err
+}
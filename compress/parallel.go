@@ -0,0 +1,198 @@
+package compress
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/adler32"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// DefaultParallelBlockSize is the size of the blocks compressed concurrently
+// by a ParallelDeflateWriter
+const DefaultParallelBlockSize = 1 << 20
+
+var errParallelWriterClosed = errors.New("compress: parallel deflate writer closed")
+
+// ParallelDeflateWriter is a deflate writer for very large streams: its input
+// is split into blocks compressed concurrently, each block using the end of
+// the previous one as dictionary, and the results are written to the
+// underlying writer in order as a single standard zlib stream.
+type ParallelDeflateWriter struct {
+	w         io.Writer
+	level     int
+	blockSize int
+
+	buf    []byte
+	dict   []byte
+	digest hash.Hash32
+
+	blocks chan chan parallelBlock
+	done   chan struct{}
+	closed bool
+
+	mu  sync.Mutex
+	err error
+}
+
+type parallelBlock struct {
+	b   []byte
+	err error
+}
+
+// NewParallelDeflateWriter returns a ParallelDeflateWriter compressing blocks
+// of blockSize bytes with the given level on up to workers goroutines. Zero
+// values select DefaultParallelBlockSize and GOMAXPROCS. Close must be called
+// to finish the stream.
+func NewParallelDeflateWriter(w io.Writer, level, blockSize, workers int) *ParallelDeflateWriter {
+	if blockSize <= 0 {
+		blockSize = DefaultParallelBlockSize
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		level = CompressDefaultCompression
+	}
+	pw := &ParallelDeflateWriter{
+		w:         w,
+		level:     level,
+		blockSize: blockSize,
+		digest:    adler32.New(),
+		blocks:    make(chan chan parallelBlock, workers),
+		done:      make(chan struct{}),
+	}
+	go pw.writeBlocks()
+	return pw
+}
+
+func (pw *ParallelDeflateWriter) Write(p []byte) (int, error) {
+	if pw.closed {
+		return 0, errParallelWriterClosed
+	}
+	if err := pw.loadErr(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	pw.digest.Write(p)
+	for len(p) > 0 {
+		if pw.buf == nil {
+			pw.buf = make([]byte, 0, pw.blockSize)
+		}
+		m := min(len(p), pw.blockSize-len(pw.buf))
+		pw.buf = append(pw.buf, p[:m]...)
+		p = p[m:]
+		if len(pw.buf) == pw.blockSize {
+			pw.dispatch(false)
+		}
+	}
+	return n, nil
+}
+
+// Close compresses the remaining data, waits for the pending blocks to be
+// written and writes the end of the stream.
+func (pw *ParallelDeflateWriter) Close() error {
+	if pw.closed {
+		return pw.loadErr()
+	}
+	pw.closed = true
+	pw.dispatch(true)
+	close(pw.blocks)
+	<-pw.done
+	if err := pw.loadErr(); err != nil {
+		return err
+	}
+	_, err := pw.w.Write(binary.BigEndian.AppendUint32(nil, pw.digest.Sum32()))
+	return err
+}
+
+// dispatch compresses the buffered data in a new goroutine, final blocks end
+// the deflate stream and the others are sync flushed
+func (pw *ParallelDeflateWriter) dispatch(final bool) {
+	block, dict := pw.buf, pw.dict
+	pw.buf = nil
+	// the window of the next block is the end of this one
+	pw.dict = block[max(0, len(block)-32<<10):]
+	res := make(chan parallelBlock, 1)
+	pw.blocks <- res
+	go func() {
+		var out byteSliceWriter
+		fw, err := flate.NewWriterDict(&out, pw.level, dict)
+		if err == nil {
+			if _, err = fw.Write(block); err == nil {
+				if final {
+					err = fw.Close()
+				} else {
+					err = fw.Flush()
+				}
+			}
+		}
+		res <- parallelBlock{b: out.b, err: err}
+	}()
+}
+
+// writeBlocks writes the zlib header and the compressed blocks in order
+func (pw *ParallelDeflateWriter) writeBlocks() {
+	defer close(pw.done)
+	_, err := pw.w.Write(appendZlibHeader(nil, pw.level))
+	pw.storeErr(err)
+	for res := range pw.blocks {
+		// keep receiving after an error so that dispatch doesn't block
+		block := <-res
+		if pw.loadErr() != nil {
+			continue
+		}
+		err = block.err
+		if err == nil {
+			_, err = pw.w.Write(block.b)
+		}
+		pw.storeErr(err)
+	}
+}
+
+func (pw *ParallelDeflateWriter) storeErr(err error) {
+	if err == nil {
+		return
+	}
+	pw.mu.Lock()
+	pw.err = err
+	pw.mu.Unlock()
+}
+
+func (pw *ParallelDeflateWriter) loadErr() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
+
+// NewParallelDeflateReader is like NewDeflateReader, but compresses the data
+// read from r with a ParallelDeflateWriter using the default block size and
+// workers. Close stops the compression and closes r if it is an io.Closer.
+func NewParallelDeflateReader(r io.Reader, level int) io.ReadCloser {
+	pr, pwr := io.Pipe()
+	go func() {
+		zw := NewParallelDeflateWriter(pwr, level, 0, 0)
+		_, err := io.Copy(zw, r)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+		pwr.CloseWithError(err)
+	}()
+	return &parallelDeflateReader{PipeReader: pr, r: r}
+}
+
+type parallelDeflateReader struct {
+	*io.PipeReader
+	r io.Reader
+}
+
+func (p *parallelDeflateReader) Close() error {
+	p.PipeReader.Close()
+	if c, ok := p.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package compress
+
+import (
+	"compress/zlib"
+	"io"
+	"sync"
+)
+
+// Pools is a set of deflate writer and inflate reader pools. The package
+// functions share global pools, a Pools keeps the writers of its users apart
+// from the others, e.g. to isolate the tenants of a multi-tenant server. Like
+// the global ones, its pools are emptied by the GC and not bounded.
+type Pools struct {
+	writerPoolMap []*sync.Pool
+	readerPool    sync.Pool
+}
+
+// NewPools returns an empty Pools
+func NewPools() *Pools {
+	return &Pools{writerPoolMap: newCompressWriterPoolMap()}
+}
+
+// AppendDeflateBytesLevel is like the package AppendDeflateBytesLevel, using
+// the writers of p.
+func (p *Pools) AppendDeflateBytesLevel(dst, src []byte, level int) ([]byte, error) {
+	w := &byteSliceWriter{dst}
+	zw := p.acquireWriter(w, level)
+	_, err := zw.Write(src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	p.writerPoolMap[normalizeCompressLevel(level)].Put(zw)
+	return w.b, err
+}
+
+// AppendInflateBytes is like the package AppendInflateBytes, using the readers
+// of p.
+func (p *Pools) AppendInflateBytes(dst, src []byte) ([]byte, error) {
+	w := &byteSliceWriter{dst}
+	r := &byteSliceReader{src}
+	var zr io.ReadCloser
+	if v := p.readerPool.Get(); v != nil {
+		zr = v.(io.ReadCloser)
+		if err := resetFlateReader(zr, r); err != nil {
+			return dst, err
+		}
+	} else {
+		var err error
+		if zr, err = zlib.NewReader(r); err != nil {
+			return dst, err
+		}
+	}
+	_, err := io.Copy(w, zr)
+	zr.Close()
+	p.readerPool.Put(zr)
+	return w.b, err
+}
+
+func (p *Pools) acquireWriter(w io.Writer, level int) *zlib.Writer {
+	if v := p.writerPoolMap[normalizeCompressLevel(level)].Get(); v != nil {
+		zw := v.(*zlib.Writer)
+		zw.Reset(w)
+		return zw
+	}
+	// invalid levels are clamped as by the package functions
+	zw, _ := zlib.NewWriterLevel(w, clampCompressLevel(level))
+	return zw
+}
@@ -0,0 +1,48 @@
+package compress
+
+import (
+	"runtime"
+	"sync/atomic"
+
+	"github.com/cloudwego/hertz/pkg/common/stackless"
+)
+
+// maxStacklessShards caps the number of shards: each stackless func starts
+// GOMAXPROCS workers of its own
+const maxStacklessShards = 8
+
+// stacklessShards returns the number of stackless funcs small writes are spread
+// over
+func stacklessShards() int {
+	n := runtime.GOMAXPROCS(-1)
+	if n > maxStacklessShards {
+		n = maxStacklessShards
+	}
+	return n
+}
+
+// shardedFunc spreads calls over several stackless wrappers of the same
+// function, each with its own work queue, so that concurrent callers don't all
+// contend on a single channel.
+type shardedFunc struct {
+	f      func(ctx interface{})
+	shards []func(ctx interface{}) bool
+	next   uint32
+}
+
+func newShardedFunc(f func(ctx interface{}), n int) *shardedFunc {
+	s := &shardedFunc{f: f, shards: make([]func(ctx interface{}) bool, n)}
+	for i := range s.shards {
+		s.shards[i] = stackless.NewFunc(f)
+	}
+	return s
+}
+
+// call runs f with ctx on the stackless goroutines of the next shard, or on the
+// caller's stack when that shard is overloaded
+func (s *shardedFunc) call(ctx interface{}) {
+	i := atomic.AddUint32(&s.next, 1) % uint32(len(s.shards))
+	if !s.shards[i](ctx) {
+		s.f(ctx)
+	}
+}
@@ -0,0 +1,118 @@
+package compress
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// SpoolWriter collects written data in memory up to a threshold and spills
+// all of it to a temporary file beyond, bounding the memory held by the
+// output of large compressions.
+type SpoolWriter struct {
+	threshold int
+	dir       string
+
+	buf []byte
+	f   *os.File
+	n   int64
+	err error
+}
+
+// NewSpoolWriter returns a SpoolWriter keeping up to threshold bytes in memory
+// and creating its temporary file in dir, os.TempDir() when empty
+func NewSpoolWriter(threshold int, dir string) *SpoolWriter {
+	return &SpoolWriter{threshold: threshold, dir: dir}
+}
+
+func (s *SpoolWriter) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.f == nil && len(s.buf)+len(p) > s.threshold {
+		if s.f, s.err = os.CreateTemp(s.dir, "deflate-spool-*"); s.err != nil {
+			return 0, s.err
+		}
+		_, s.err = s.f.Write(s.buf)
+		s.buf = nil
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.f == nil {
+		s.buf = append(s.buf, p...)
+		s.n += int64(len(p))
+		return len(p), nil
+	}
+	n, err := s.f.Write(p)
+	s.n += int64(n)
+	s.err = err
+	return n, err
+}
+
+// Len returns the number of bytes written
+func (s *SpoolWriter) Len() int64 {
+	return s.n
+}
+
+// Spilled reports whether the data was spilled to a temporary file
+func (s *SpoolWriter) Spilled() bool {
+	return s.f != nil
+}
+
+// Reader returns a reader of the written data, which must not be written to
+// anymore. Closing it removes the temporary file, which is also removed when
+// Reader fails.
+func (s *SpoolWriter) Reader() (io.ReadCloser, error) {
+	if s.f == nil {
+		return io.NopCloser(bytes.NewReader(s.buf)), s.err
+	}
+	if s.err == nil {
+		_, s.err = s.f.Seek(0, io.SeekStart)
+	}
+	if s.err != nil {
+		s.remove()
+		return nil, s.err
+	}
+	return &spoolFile{s}, nil
+}
+
+func (s *SpoolWriter) remove() error {
+	err := s.f.Close()
+	if rerr := os.Remove(s.f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+type spoolFile struct {
+	s *SpoolWriter
+}
+
+func (f *spoolFile) Read(p []byte) (int, error) {
+	return f.s.f.Read(p)
+}
+
+func (f *spoolFile) Close() error {
+	return f.s.remove()
+}
+
+// DeflateSpooled deflates src with the given level into a SpoolWriter, see
+// NewSpoolWriter, and returns a reader of the result along with its size.
+func DeflateSpooled(src []byte, level, threshold int, dir string) (io.ReadCloser, int64, error) {
+	s := NewSpoolWriter(threshold, dir)
+	zw := AcquireStacklessDeflateWriter(s, level)
+	_, err := zw.Write(src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	stacklessDeflateWriterPoolMap[normalizeCompressLevel(level)].Put(zw)
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+	r, err := s.Reader()
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, s.Len(), nil
+}
@@ -0,0 +1,227 @@
+package compress
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+
+	"github.com/cloudwego/hertz/pkg/common/stackless"
+)
+
+// streamChunkSize is the size of the reads from the source of a deflateReader
+const streamChunkSize = 32 << 10
+
+type deflateReader struct {
+	r     io.Reader
+	level int
+	zw    *zlib.Writer
+	buf   bytes.Buffer
+	chunk []byte
+	err   error
+}
+
+// NewDeflateReader returns a reader yielding the deflate encoding of the data
+// read from r. The data is compressed as it is pulled, each read from r being
+// flushed, so producers writing through a pipe see their output sent as soon
+// as it is written. Close releases the pooled writer and closes r if it is an
+// io.Closer.
+func NewDeflateReader(r io.Reader, level int) io.ReadCloser {
+	return NewDeflateReaderSize(r, level, streamChunkSize)
+}
+
+// NewDeflateReaderSize is like NewDeflateReader, but reads at most maxBuffer
+// bytes from r at a time. r is only read once the output of the previous read
+// has been consumed, so a slow consumer holds back the reads from r, and the
+// reader never buffers much more than maxBuffer bytes.
+func NewDeflateReaderSize(r io.Reader, level, maxBuffer int) io.ReadCloser {
+	if maxBuffer <= 0 {
+		maxBuffer = streamChunkSize
+	}
+	d := &deflateReader{r: r, level: level, chunk: make([]byte, maxBuffer)}
+	d.zw = acquireRealDeflateWriter(&d.buf, level)
+	return d
+}
+
+func (d *deflateReader) Read(p []byte) (int, error) {
+	for d.buf.Len() == 0 && d.err == nil {
+		n, err := d.r.Read(d.chunk)
+		if n > 0 {
+			if _, d.err = d.zw.Write(d.chunk[:n]); d.err == nil {
+				d.err = d.zw.Flush()
+			}
+		}
+		if d.err != nil {
+			break
+		}
+		if err == io.EOF {
+			if d.err = d.zw.Close(); d.err == nil {
+				d.err = io.EOF
+			}
+		} else if err != nil {
+			d.err = err
+		}
+	}
+	if d.buf.Len() > 0 {
+		return d.buf.Read(p)
+	}
+	return 0, d.err
+}
+
+func (d *deflateReader) Close() error {
+	if d.zw != nil {
+		// releaseRealDeflateWriter would close it, finishing a stream nobody
+		// reads anymore
+		d.zw.Reset(io.Discard)
+		releaseRealDeflateWriter(d.zw, d.level)
+		d.zw = nil
+	}
+	if d.err == nil {
+		d.err = io.ErrClosedPipe
+	}
+	if c, ok := d.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// StacklessDeflateWriter is a pooled deflate writer compressing on the
+// stackless goroutines, for streams written from many concurrent goroutines.
+type StacklessDeflateWriter struct {
+	sw    stackless.Writer
+	level int
+}
+
+// NewStacklessDeflateWriter returns a StacklessDeflateWriter writing the deflate
+// encoding of its input to w using the given compression level. Close must be
+// called to finish the stream and give the writer back to the pool.
+func NewStacklessDeflateWriter(w io.Writer, level int) *StacklessDeflateWriter {
+	return &StacklessDeflateWriter{sw: AcquireStacklessDeflateWriter(w, level), level: level}
+}
+
+func (w *StacklessDeflateWriter) Write(p []byte) (int, error) {
+	if w.sw == nil {
+		return 0, io.ErrClosedPipe
+	}
+	return w.sw.Write(p)
+}
+
+// ReadFrom compresses the data read from r until EOF through a pooled buffer,
+// so io.Copy doesn't allocate one, and returns the number of bytes read.
+func (w *StacklessDeflateWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.sw == nil {
+		return 0, io.ErrClosedPipe
+	}
+	buf := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(buf)
+	var n int64
+	for {
+		nr, err := r.Read(*buf)
+		if nr > 0 {
+			if _, werr := w.sw.Write((*buf)[:nr]); werr != nil {
+				return n, werr
+			}
+			n += int64(nr)
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// Flush sync flushes the zlib writer, so everything written so far reaches the
+// underlying writer and can be inflated by the peer, e.g. for server-sent
+// events or chunked responses.
+func (w *StacklessDeflateWriter) Flush() error {
+	if w.sw == nil {
+		return io.ErrClosedPipe
+	}
+	return w.sw.Flush()
+}
+
+// Close writes the end of the stream and releases the pooled writer.
+func (w *StacklessDeflateWriter) Close() error {
+	if w.sw == nil {
+		return nil
+	}
+	err := w.sw.Close()
+	// releaseStacklessDeflateWriter would close it again, appending a second
+	// checksum to the finished stream
+	stacklessDeflateWriterPoolMap[normalizeCompressLevel(w.level)].Put(w.sw)
+	w.sw = nil
+	return err
+}
+
+type pooledInflateReader struct {
+	zr  io.ReadCloser
+	r   io.Reader
+	err error
+}
+
+// NewPooledInflateReadCloser returns a reader inflating the zlib stream read from
+// r with a pooled zlib reader, which is given back to the pool at the end of the
+// stream, on the first read error or on Close, whichever comes first. Close also
+// closes r if it is an io.Closer.
+func NewPooledInflateReadCloser(r io.Reader) (io.ReadCloser, error) {
+	zr, err := acquireFlateReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledInflateReader{zr: zr, r: r}, nil
+}
+
+func (p *pooledInflateReader) Read(b []byte) (int, error) {
+	if p.zr == nil {
+		return 0, p.err
+	}
+	n, err := p.zr.Read(b)
+	if err != nil {
+		releaseFlateReader(p.zr)
+		p.zr = nil
+		p.err = err
+	}
+	return n, err
+}
+
+// WriteTo writes the rest of the inflated stream to w through a pooled buffer,
+// so io.Copy doesn't allocate one, and returns the number of bytes written.
+func (p *pooledInflateReader) WriteTo(w io.Writer) (int64, error) {
+	buf := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(buf)
+	var n int64
+	for {
+		nr, err := p.Read(*buf)
+		if nr > 0 {
+			nw, werr := w.Write((*buf)[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+			if nw < nr {
+				return n, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+func (p *pooledInflateReader) Close() error {
+	if p.zr != nil {
+		releaseFlateReader(p.zr)
+		p.zr = nil
+	}
+	if p.err == nil {
+		p.err = io.ErrClosedPipe
+	}
+	if c, ok := p.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package deflate
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a declarative alternative to the functional options of Deflate.
+// Unlike the options it is validated up front, see Validate. The options taking
+// functions, hooks or shared state, such as WithPolicyFn, WithMetricsHook or
+// WithPools, and the proxy, CDN, spooling and streaming options are code-only:
+// pass them to New along with the config.
+type Config struct {
+	// Level is the compression level. Decoded documents omitting it get
+	// DefaultCompression, but the zero value of a literal is NoCompression.
+	Level int `yaml:"level"`
+	// ExcludedExtensions replaces DefaultExcludedExtensions when not nil
+	ExcludedExtensions  []string        `yaml:"excluded_extensions"`
+	ExcludedPaths       []string        `yaml:"excluded_paths"`
+	ExcludedPathRegexes []string        `yaml:"excluded_path_regexes"`
+	DecompressFn        app.HandlerFunc `yaml:"-"`
+	AdaptiveLevel       bool            `yaml:"adaptive_level"`
+	EntropyThreshold    float64         `yaml:"entropy_threshold"`
+	SniffContentType    bool            `yaml:"sniff_content_type"`
+	MemoryBudget        *MemoryBudget   `yaml:"-"`
+	DisableVary         bool            `yaml:"disable_vary"`
+	ETagPolicy          ETagPolicy      `yaml:"etag_policy"`
+	IntegrityPolicy     IntegrityPolicy `yaml:"integrity_policy"`
+	LegacyEncodings     bool            `yaml:"legacy_encodings"`
+	EncodingPriority    []string        `yaml:"encoding_priority"`
+	PaddingBlock        int             `yaml:"padding_block"`
+	// MinSize and MaxSize are the bounds of WithExcludedSizeRange
+	MinSize              int      `yaml:"min_size"`
+	MaxSize              int      `yaml:"max_size"`
+	IncludedContentTypes []string `yaml:"included_content_types"`
+	// ExcludedMethods replaces DefaultExcludedMethods when not nil
+	ExcludedMethods      []string `yaml:"excluded_methods"`
+	ExcludedRouteNames   []string `yaml:"excluded_route_names"`
+	ExplicitIdentity     bool     `yaml:"explicit_identity"`
+	HTTP10Compression    bool     `yaml:"http10_compression"`
+	OriginalLengthHeader bool     `yaml:"original_length_header"`
+	ChunkedResponses     bool     `yaml:"chunked_responses"`
+}
+
+// ClientConfig is the declarative alternative to the functional options of
+// DeflateForClient. Like for Config, the other options are passed to NewForClient.
+type ClientConfig struct {
+	// Level is the compression level. Decoded documents omitting it get
+	// DefaultCompression, but the zero value of a literal is NoCompression.
+	Level int `yaml:"level"`
+	// ExcludedExtensions replaces DefaultClientExcludedExtensions when not nil
+	ExcludedExtensions    []string          `yaml:"excluded_extensions"`
+	ExcludedPaths         []string          `yaml:"excluded_paths"`
+	ExcludedPathRegexes   []string          `yaml:"excluded_path_regexes"`
+	DecompressFnForClient client.Middleware `yaml:"-"`
+	AdaptiveLevel         bool              `yaml:"adaptive_level"`
+	MemoryBudget          *MemoryBudget     `yaml:"-"`
+	DisableVary           bool              `yaml:"disable_vary"`
+	LegacyEncodings       bool              `yaml:"legacy_encodings"`
+}
+
+// plainConfig and plainClientConfig are the configs without their UnmarshalYAML
+type (
+	plainConfig       Config
+	plainClientConfig ClientConfig
+)
+
+// UnmarshalYAML decodes the config, defaulting Level to DefaultCompression so
+// that a document omitting it doesn't turn compression off
+func (cfg *Config) UnmarshalYAML(value *yaml.Node) error {
+	decoded := plainConfig{Level: DefaultCompression}
+	if err := value.Decode(&decoded); err != nil {
+		return err
+	}
+	*cfg = Config(decoded)
+	return nil
+}
+
+// UnmarshalYAML decodes the config, defaulting Level to DefaultCompression
+func (cfg *ClientConfig) UnmarshalYAML(value *yaml.Node) error {
+	decoded := plainClientConfig{Level: DefaultCompression}
+	if err := value.Decode(&decoded); err != nil {
+		return err
+	}
+	*cfg = ClientConfig(decoded)
+	return nil
+}
+
+// Validate reports the first invalid setting of the config
+func (cfg Config) Validate() error {
+	if cfg.Level < HuffmanOnly || cfg.Level > BestCompression {
+		return fmt.Errorf("deflate: invalid compression level %d", cfg.Level)
+	}
+	for _, ext := range cfg.ExcludedExtensions {
+		if strings.Contains(ext, "*") {
+			if _, err := path.Match(ext, ""); err != nil {
+				return fmt.Errorf("deflate: invalid excluded extension pattern %q: %w", ext, err)
+			}
+		} else if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("deflate: excluded extension %q must start with a dot", ext)
+		}
+	}
+	for _, path := range cfg.ExcludedPaths {
+		if path == "" {
+			return fmt.Errorf("deflate: excluded path must not be empty")
+		}
+	}
+	for _, reg := range cfg.ExcludedPathRegexes {
+		if _, err := regexp.Compile(reg); err != nil {
+			return fmt.Errorf("deflate: invalid excluded path regex %q: %w", reg, err)
+		}
+	}
+	if cfg.ETagPolicy < ETagKeep || cfg.ETagPolicy > ETagSuffix {
+		return fmt.Errorf("deflate: unknown ETag policy %d", cfg.ETagPolicy)
+	}
+	if cfg.IntegrityPolicy < IntegrityDrop || cfg.IntegrityPolicy > IntegrityKeep {
+		return fmt.Errorf("deflate: unknown integrity policy %d", cfg.IntegrityPolicy)
+	}
+	if cfg.PaddingBlock < 0 {
+		return fmt.Errorf("deflate: negative padding block %d", cfg.PaddingBlock)
+	}
+	if cfg.EntropyThreshold < 0 || cfg.EntropyThreshold > 8 {
+		return fmt.Errorf("deflate: entropy threshold %v out of range [0, 8]", cfg.EntropyThreshold)
+	}
+	for _, mediaType := range cfg.IncludedContentTypes {
+		if !strings.Contains(mediaType, "/") {
+			return fmt.Errorf("deflate: invalid included content type %q", mediaType)
+		}
+	}
+	// the settings below are valid on their own but leave every response uncompressed together
+	if cfg.MaxSize > 0 && cfg.MinSize > cfg.MaxSize {
+		return fmt.Errorf("deflate: min size %d exceeds max size %d", cfg.MinSize, cfg.MaxSize)
+	}
+	if len(cfg.EncodingPriority) > 0 && !containsFold(cfg.EncodingPriority, "deflate") {
+		return fmt.Errorf("deflate: encoding priority %q leaves out deflate", cfg.EncodingPriority)
+	}
+	return nil
+}
+
+// containsFold reports whether list holds s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate reports the first invalid setting of the config
+func (cfg ClientConfig) Validate() error {
+	return Config{
+		Level:               cfg.Level,
+		ExcludedExtensions:  cfg.ExcludedExtensions,
+		ExcludedPaths:       cfg.ExcludedPaths,
+		ExcludedPathRegexes: cfg.ExcludedPathRegexes,
+	}.Validate()
+}
+
+// New returns the server middleware described by cfg, or the validation error.
+// opts are applied after the config, e.g. for the code-only options.
+func New(cfg Config, opts ...Option) (app.HandlerFunc, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return Deflate(cfg.Level, append(cfg.options(), opts...)...), nil
+}
+
+func (cfg Config) options() []Option {
+	opts := []Option{
+		WithExcludedPaths(cfg.ExcludedPaths),
+		WithExcludedPathRegexes(cfg.ExcludedPathRegexes),
+		WithDecompressFn(cfg.DecompressFn),
+		WithEntropyThreshold(cfg.EntropyThreshold),
+		WithMemoryBudget(cfg.MemoryBudget),
+		WithETagPolicy(cfg.ETagPolicy),
+		WithIntegrityPolicy(cfg.IntegrityPolicy),
+		WithEncodingPriority(cfg.EncodingPriority),
+		WithPadding(cfg.PaddingBlock),
+		WithExcludedSizeRange(cfg.MinSize, cfg.MaxSize),
+		WithIncludedContentTypes(cfg.IncludedContentTypes),
+		WithExcludedRouteNames(cfg.ExcludedRouteNames),
+	}
+	if cfg.ExcludedMethods != nil {
+		opts = append(opts, WithExcludedMethods(cfg.ExcludedMethods))
+	}
+	if cfg.ExplicitIdentity {
+		opts = append(opts, WithExplicitIdentity())
+	}
+	if cfg.HTTP10Compression {
+		opts = append(opts, WithHTTP10Compression())
+	}
+	if cfg.OriginalLengthHeader {
+		opts = append(opts, WithOriginalLengthHeader())
+	}
+	if cfg.ChunkedResponses {
+		opts = append(opts, WithChunkedResponses())
+	}
+	if cfg.ExcludedExtensions != nil {
+		opts = append(opts, WithExcludedExtensions(cfg.ExcludedExtensions))
+	}
+	if cfg.AdaptiveLevel {
+		opts = append(opts, WithAdaptiveLevel())
+	}
+	if cfg.SniffContentType {
+		opts = append(opts, WithContentTypeSniffing())
+	}
+	if cfg.DisableVary {
+		opts = append(opts, WithoutVaryHeader())
+	}
+	if cfg.LegacyEncodings {
+		opts = append(opts, WithLegacyEncodings())
+	}
+	return opts
+}
+
+// NewForClient returns the client middleware described by cfg, or the validation
+// error. opts are applied after the config.
+func NewForClient(cfg ClientConfig, opts ...ClientOption) (client.Middleware, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return DeflateForClient(cfg.Level, append(cfg.options(), opts...)...), nil
+}
+
+func (cfg ClientConfig) options() []ClientOption {
+	opts := []ClientOption{
+		WithExcludedPathsForClient(cfg.ExcludedPaths),
+		WithExcludedPathRegexesForClient(cfg.ExcludedPathRegexes),
+		WithDecompressFnForClient(cfg.DecompressFnForClient),
+		WithMemoryBudgetForClient(cfg.MemoryBudget),
+	}
+	if cfg.ExcludedExtensions != nil {
+		opts = append(opts, WithExcludedExtensionsForClient(cfg.ExcludedExtensions))
+	}
+	if cfg.AdaptiveLevel {
+		opts = append(opts, WithAdaptiveLevelForClient())
+	}
+	if cfg.DisableVary {
+		opts = append(opts, WithoutVaryHeaderForClient())
+	}
+	if cfg.LegacyEncodings {
+		opts = append(opts, WithLegacyEncodingsForClient())
+	}
+	return opts
+}
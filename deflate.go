@@ -2,6 +2,11 @@ package deflate
 
 import (
 	"compress/flate"
+	"math"
+	"net/http"
+	"strings"
+
+	"deflate/compress"
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/app/client"
 )
@@ -11,12 +16,105 @@ const (
 	BestSpeed          = flate.BestSpeed
 	DefaultCompression = flate.DefaultCompression
 	NoCompression      = flate.NoCompression
+	HuffmanOnly        = flate.HuffmanOnly
+)
+
+// Presets naming the usual speed/size trade-offs, e.g. Deflate(Balanced).
+// Every preset uses the deflate codec.
+const (
+	Fastest  = BestSpeed
+	Balanced = DefaultCompression
+	Smallest = BestCompression
+)
+
+// LevelContextKey is the RequestContext key under which earlier middlewares or
+// the handler may store an int compression level overriding the configured one.
+const LevelContextKey = "deflate.level"
+
+// DefaultEntropyThreshold is the entropy in bits per byte above which a body
+// is considered incompressible.
+const DefaultEntropyThreshold = 7.5
+
+const entropySampleSize = 4 << 10
+
+// incompressibleContentTypes are sniffed media types (or type prefixes) whose
+// payload is already compressed.
+var incompressibleContentTypes = []string{
+	"image/", "audio/", "video/",
+	"font/woff", "application/ogg", "application/pdf",
+	"application/zip", "application/x-gzip", "application/x-rar-compressed",
+}
+
+const (
+	adaptiveSmallBodySize = 1 << 10
+	adaptiveLargeBodySize = 64 << 10
 )
 
+// Deflate returns the server middleware compressing responses with the given level.
+//
+// It has to be installed with h.Use(deflate.Deflate(level)): Hertz config.Option
+// values only tune the server options and cannot register middlewares, so there
+// is no server.Default(deflate.WithServer(...)) equivalent.
 func Deflate(level int, options ...Option) app.HandlerFunc {
-	return newDeflateSrvMiddleware(level, options...).SrvMiddleware
+	return NewDeflateSrvMiddleware(level, options...).SrvMiddleware
 }
 
 func DeflateForClient(level int, options ...ClientOption) client.Middleware {
-	return newDeflateClientMiddleware(level, options...).ClientMiddleware
+	return NewDeflateClientMiddleware(level, options...).ClientMiddleware
+}
+
+// Warmup pre-allocates n pooled deflate writers for the given level, call it
+// at startup for every level in use to avoid cold-pool latency after a deploy.
+func Warmup(level, n int) {
+	compress.PrewarmPools(level, n)
+}
+
+// adaptiveLevel returns BestSpeed for bodies smaller than 1KB and BestCompression
+// for bodies of 64KB and more, keeping the configured level in between.
+func adaptiveLevel(level, size int) int {
+	switch {
+	case size < adaptiveSmallBodySize:
+		return BestSpeed
+	case size >= adaptiveLargeBodySize:
+		return BestCompression
+	default:
+		return level
+	}
+}
+
+// sampleEntropy returns the Shannon entropy in bits per byte of the first
+// entropySampleSize bytes of p.
+func sampleEntropy(p []byte) float64 {
+	if len(p) > entropySampleSize {
+		p = p[:entropySampleSize]
+	}
+	if len(p) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range p {
+		counts[b]++
+	}
+	var entropy float64
+	n := float64(len(p))
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		f := float64(count) / n
+		entropy -= f * math.Log2(f)
+	}
+	return entropy
+}
+
+// sniffIncompressible reports whether the content type detected from body is
+// known to be already compressed.
+func sniffIncompressible(body []byte) bool {
+	contentType := http.DetectContentType(body)
+	for _, prefix := range incompressibleContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
 }
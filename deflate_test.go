@@ -1,25 +1,46 @@
 package deflate
 
 import (
+	"bufio"
 	"bytes"
 	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
 	"deflate/compress"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/app/client/retry"
 	"github.com/cloudwego/hertz/pkg/app/server"
 	"github.com/cloudwego/hertz/pkg/common/config"
 	"github.com/cloudwego/hertz/pkg/common/ut"
+	"github.com/cloudwego/hertz/pkg/network"
 	"github.com/cloudwego/hertz/pkg/protocol"
 	"github.com/cloudwego/hertz/pkg/protocol/consts"
 	"github.com/cloudwego/hertz/pkg/route"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -62,54 +83,2120 @@ func TestWildcard(t *testing.T) {
 	assert.Equal(t, fmt.Sprint(len(w.Body())), w.Header.Get("Content-Length"))
 }
 
-func TestDeflatePNG(t *testing.T) {
+func TestAcceptsEncoding(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"deflate":                true,
+		" Deflate ":              true,
+		"gzip, deflate;q=0.5":    true,
+		"x-deflate-foo":          false,
+		"gzip":                   false,
+		"deflate;q=0":            false,
+		"*":                      true,
+		"*;q=0":                  false,
+		"*, deflate;q=0":         false,
+		"gzip;q=1.0, DEFLATE":    true,
+		"":                       false,
+		"deflate; q=0.000, gzip": false,
+	} {
+		assert.Equal(t, expected, acceptsEncoding(header, "deflate"), header)
+	}
+	assert.True(t, isContentEncoding(" DEFLATE ", "deflate", false))
+	assert.False(t, isContentEncoding("gzip, deflate", "deflate", false))
+	assert.False(t, isContentEncoding("x-deflate", "deflate", false))
+	assert.True(t, isContentEncoding("x-deflate", "deflate", true))
+}
+
+func TestMultipleAcceptEncodingHeaders(t *testing.T) {
+	req := protocol.AcquireRequest()
+	defer protocol.ReleaseRequest(req)
+	req.SetRequestURI("/")
+	req.Header.Add("Accept-Encoding", "gzip")
+	req.Header.Add("Accept-Encoding", "deflate")
+	assert.True(t, NewDeflateSrvMiddleware(DefaultCompression).ShouldCompress(req))
+}
+
+func TestStreamingRequestDetection(t *testing.T) {
+	middleware := NewDeflateSrvMiddleware(DefaultCompression)
+	for headers, expected := range map[[2]string]bool{
+		{"Connection", "keep-alive, upgrade"}:           false,
+		{"Connection", "X-Upgraded"}:                    true,
+		{"Accept", "text/event-stream"}:                 false,
+		{"Accept", "text/html, text/event-stream;q=0"}:  true,
+		{"Accept", "application/x-text/event-stream-1"}: true,
+	} {
+		req := protocol.AcquireRequest()
+		req.SetRequestURI("/")
+		req.Header.Set("Accept-Encoding", "deflate")
+		req.Header.Set(headers[0], headers[1])
+		assert.Equal(t, expected, middleware.ShouldCompress(req), headers)
+		protocol.ReleaseRequest(req)
+	}
+
 	router := route.NewEngine(config.NewOptions([]config.Option{}))
 	router.Use(Deflate(DefaultCompression))
-	router.GET("/image.png", func(ctx context.Context, c *app.RequestContext) {
-		c.String(200, "this is a PNG!")
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "text/event-stream; charset=utf-8", []byte(testResponse))
 	})
-	request := ut.PerformRequest(router, consts.MethodGet, "/image.png", nil, ut.Header{
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
 		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(w.Body()))
+}
+
+func TestHTTP10Requests(t *testing.T) {
+	req := protocol.AcquireRequest()
+	defer protocol.ReleaseRequest(req)
+	req.SetRequestURI("/")
+	req.Header.SetProtocol(consts.HTTP10)
+	req.Header.Set("Accept-Encoding", "*")
+	assert.False(t, NewDeflateSrvMiddleware(DefaultCompression).ShouldCompress(req))
+	assert.True(t, NewDeflateSrvMiddleware(DefaultCompression, WithHTTP10Compression()).ShouldCompress(req))
+
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	assert.True(t, NewDeflateSrvMiddleware(DefaultCompression).ShouldCompress(req))
+
+	req.Header.SetProtocol(consts.HTTP11)
+	req.Header.Set("Accept-Encoding", "*")
+	assert.True(t, NewDeflateSrvMiddleware(DefaultCompression).ShouldCompress(req))
+}
+
+func TestAbortedRequests(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(403, testResponse)
+		c.Abort()
 	})
-	w := request.Result()
-	assert.Equal(t, w.StatusCode(), 200)
-	assert.Equal(t, w.Header.Get("Content-Encoding"), "")
-	assert.Equal(t, w.Header.Get("Vary"), "")
-	assert.Equal(t, string(w.Body()), "this is a PNG!")
+	// the body of an aborted response is still written, uncompressed
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, 403, w.StatusCode())
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(w.Body()))
+	assert.Equal(t, len(testResponse), w.Header.ContentLength())
+
+	newContext := func() *app.RequestContext {
+		c := app.NewContext(0)
+		c.Request.SetRequestURI("/")
+		c.Request.Header.Set("Accept-Encoding", "deflate")
+		c.String(200, testResponse)
+		return c
+	}
+	middleware := NewDeflateSrvMiddleware(DefaultCompression)
+	c := newContext()
+	middleware.SrvMiddleware(context.Background(), c)
+	assert.Equal(t, "deflate", c.Response.Header.Get("Content-Encoding"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c = newContext()
+	middleware.SrvMiddleware(ctx, c)
+	assert.Equal(t, "", c.Response.Header.Get("Content-Encoding"))
 }
 
-func TestExcludedExtensions(t *testing.T) {
+func TestShouldCompressReason(t *testing.T) {
+	opts := *DefaultOptions
+	WithExcludedPaths([]string{"/api/"})(&opts)
+	for uri, expected := range map[string]string{
+		"/index.html":  "",
+		"/image.png":   ReasonExcludedExtension,
+		"/api/books":   ReasonExcludedPath,
+		"/other/books": "",
+	} {
+		req := protocol.AcquireRequest()
+		req.SetRequestURI(uri)
+		req.Header.Set("Accept-Encoding", "deflate")
+		ok, reason := ShouldCompress(&opts, req)
+		assert.Equal(t, expected == "", ok)
+		assert.Equal(t, expected, reason)
+		protocol.ReleaseRequest(req)
+	}
+
+	req := protocol.AcquireRequest()
+	defer protocol.ReleaseRequest(req)
+	req.SetRequestURI("/")
+	req.Header.Set("Accept-Encoding", "gzip")
+	ok, reason := ShouldCompress(&opts, req)
+	assert.False(t, ok)
+	assert.Equal(t, ReasonNotAccepted, reason)
+}
+
+func TestUpdateOptions(t *testing.T) {
+	middleware := NewDeflateSrvMiddleware(DefaultCompression)
 	router := route.NewEngine(config.NewOptions([]config.Option{}))
-	router.Use(Deflate(DefaultCompression, WithExcludedExtensions([]string{".html"})))
-	router.GET("/index.html", func(ctx context.Context, c *app.RequestContext) {
-		c.String(200, "this is a HTML!")
+	router.Use(middleware.SrvMiddleware)
+	router.GET("/api/books", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
 	})
-	request := ut.PerformRequest(router, consts.MethodGet, "/index.html", nil, ut.Header{
+	perform := func() *protocol.Response {
+		return ut.PerformRequest(router, consts.MethodGet, "/api/books", nil, ut.Header{
+			Key: "Accept-Encoding", Value: "deflate",
+		}).Result()
+	}
+
+	w := perform()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	expected, _ := compress.AppendDeflateBytesLevel(nil, []byte(testResponse), DefaultCompression)
+	assert.Equal(t, expected, w.Body())
+
+	middleware.UpdateOptions(WithLevel(BestSpeed))
+	assert.Equal(t, BestSpeed, middleware.CurrentOptions().Level)
+	w = perform()
+	expected, _ = compress.AppendDeflateBytesLevel(nil, []byte(testResponse), BestSpeed)
+	assert.Equal(t, expected, w.Body())
+
+	middleware.UpdateOptions(WithExcludedPaths([]string{"/api/"}))
+	assert.Equal(t, BestSpeed, middleware.CurrentOptions().Level)
+	w = perform()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, DefaultCompression, middleware.Options.Level)
+}
+
+func TestExcludedRouteNames(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithExcludedRouteNames([]string{"downloadBook", "/books/:id/cover"})))
+	router.GETEX("/books/:id/download", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	}, "downloadBook")
+	router.GET("/books/:id/cover", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	router.GET("/books/:id", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	for path, expected := range map[string]string{
+		"/books/1/download": "",
+		"/books/1/cover":    "",
+		"/books/1":          "deflate",
+	} {
+		w := ut.PerformRequest(router, consts.MethodGet, path, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "deflate",
+		}).Result()
+		assert.Equal(t, expected, w.Header.Get("Content-Encoding"), path)
+	}
+}
+
+func TestOriginalLengthHeader(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithOriginalLengthHeader()))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
 		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(testResponse)), w.Header.Get(HeaderOriginalContentLength))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil).Result()
+	assert.Equal(t, "", w.Header.Get(HeaderOriginalContentLength))
+}
+
+func TestChunkedResponses(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		var options []Option
+		if chunked {
+			options = append(options, WithChunkedResponses())
+		}
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(Deflate(DefaultCompression, options...))
+		router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+			c.String(200, testResponse)
+		})
+
+		recorder := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+			Key: "Accept-Encoding", Value: "deflate",
+		})
+		assert.Equal(t, chunked, recorder.Header().ContentLength() == -1)
+		w := recorder.Result()
+		inflated, err := compress.AppendInflateBytes(nil, w.Body())
+		assert.Nil(t, err)
+		assert.Equal(t, testResponse, string(inflated))
+	}
+}
+
+func TestMetricsHook(t *testing.T) {
+	var stats []Stats
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithDecompressFn(DefaultDecompressHandle),
+		WithMetricsHook(func(c *app.RequestContext, s Stats) {
+			stats = append(stats, s)
+		})))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
 	})
-	w := request.Result()
-	assert.Equal(t, http.StatusOK, w.StatusCode())
+
+	deflated, _ := compress.AppendDeflateBytesLevel(nil, []byte(testResponse), DefaultCompression)
+	ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(deflated), Len: len(deflated)},
+		ut.Header{Key: "Content-Encoding", Value: "deflate"},
+		ut.Header{Key: "Accept-Encoding", Value: "deflate"})
+	assert.Equal(t, 2, len(stats))
+	assert.Equal(t, OperationDecompress, stats[0].Operation)
+	assert.Equal(t, len(deflated), stats[0].CompressedSize)
+	assert.Equal(t, len(testResponse), stats[0].UncompressedSize)
+	assert.Nil(t, stats[0].Err)
+	assert.Equal(t, OperationCompress, stats[1].Operation)
+	assert.Equal(t, len(deflated), stats[1].CompressedSize)
+	assert.Equal(t, len(testResponse), stats[1].UncompressedSize)
+	assert.Equal(t, float64(len(testResponse))/float64(len(deflated)), stats[1].Ratio())
+
+	stats = nil
+	ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: strings.NewReader(testResponse), Len: len(testResponse)},
+		ut.Header{Key: "Content-Encoding", Value: "deflate"})
+	assert.Equal(t, 1, len(stats))
+	assert.Equal(t, OperationDecompress, stats[0].Operation)
+	assert.NotNil(t, stats[0].Err)
+}
+
+func TestContentTypeLevels(t *testing.T) {
+	body := []byte(strings.Repeat(testResponse, 50))
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithContentTypeLevels(map[string]int{
+		"text/html":        BestCompression,
+		"Application/JSON": BestSpeed,
+	})))
+	for path, contentType := range map[string]string{
+		"/html":  "text/html; charset=utf-8",
+		"/json":  "application/json",
+		"/plain": "text/plain",
+	} {
+		contentType := contentType
+		router.GET(path, func(ctx context.Context, c *app.RequestContext) {
+			c.Data(200, contentType, body)
+		})
+	}
+
+	for path, level := range map[string]int{
+		"/html":  BestCompression,
+		"/json":  BestSpeed,
+		"/plain": DefaultCompression,
+	} {
+		w := ut.PerformRequest(router, consts.MethodGet, path, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "deflate",
+		}).Result()
+		expected, _ := compress.AppendDeflateBytesLevel(nil, body, level)
+		assert.Equal(t, expected, w.Body(), path)
+	}
+}
+
+func TestCompressFn(t *testing.T) {
+	var levels []int
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(BestSpeed, WithCompressFn(func(dst, src []byte, level int) ([]byte, error) {
+		levels = append(levels, level)
+		var buf bytes.Buffer
+		zw, _ := zlib.NewWriterLevel(&buf, BestCompression)
+		_, _ = zw.Write(src)
+		_ = zw.Close()
+		return append(dst, buf.Bytes()...), nil
+	})))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, []int{BestSpeed}, levels)
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	inflated, err := compress.AppendInflateBytes(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(inflated))
+}
+
+func TestDryRun(t *testing.T) {
+	var stats Stats
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithDryRun(), WithMetricsHook(func(c *app.RequestContext, s Stats) {
+		stats = s
+	})))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	expected, _ := compress.AppendDeflateBytesLevel(nil, []byte(testResponse), DefaultCompression)
 	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
 	assert.Equal(t, "", w.Header.Get("Vary"))
-	assert.Equal(t, "this is a HTML!", string(w.Body()))
-	assert.Equal(t, "15", w.Header.Get("Content-Length"))
+	assert.Equal(t, testResponse, string(w.Body()))
+	assert.Equal(t, strconv.Itoa(len(expected)), w.Header.Get(HeaderDryRunCompressedLength))
+	assert.True(t, stats.DryRun)
+	assert.Equal(t, len(expected), stats.CompressedSize)
 }
 
-func TestExcludedPaths(t *testing.T) {
+func TestExcludedExtensionPatterns(t *testing.T) {
+	extensions := NewExcludedExtensions([]string{".png", "*.min.*", "*.map"})
+	for uri, expected := range map[string]bool{
+		"/logo.png":              true,
+		"/static/app.min.js":     true,
+		"/static/app.min.css?v2": true,
+		"/static/app.js.map":     true,
+		"/static/app.js":         false,
+		"/static/minimal.js":     false,
+		"/search?file=logo.png":  false,
+	} {
+		assert.Equal(t, expected, extensions.Matches(uri), uri)
+	}
+
+	_, err := New(Config{Level: DefaultCompression, ExcludedExtensions: []string{"*.min.js", "*[.js"}})
+	assert.NotNil(t, err)
+	_, err = New(Config{Level: DefaultCompression, ExcludedExtensions: []string{"*.min.js", ".map"}})
+	assert.Nil(t, err)
+}
+
+func TestExcludedSizeRange(t *testing.T) {
 	router := route.NewEngine(config.NewOptions([]config.Option{}))
-	router.Use(Deflate(DefaultCompression, WithExcludedPaths([]string{"/api/"})))
-	router.GET("/api/books", func(ctx context.Context, c *app.RequestContext) {
+	router.Use(Deflate(DefaultCompression, WithExcludedSizeRange(16, 1024)))
+	router.GET("/:size", func(ctx context.Context, c *app.RequestContext) {
+		size, _ := strconv.Atoi(c.Param("size"))
+		c.String(200, strings.Repeat("a", size))
+	})
+
+	for size, expected := range map[int]string{
+		15:   "",
+		16:   "deflate",
+		1024: "deflate",
+		1025: "",
+	} {
+		w := ut.PerformRequest(router, consts.MethodGet, "/"+strconv.Itoa(size), nil, ut.Header{
+			Key: "Accept-Encoding", Value: "deflate",
+		}).Result()
+		assert.Equal(t, expected, w.Header.Get("Content-Encoding"), size)
+	}
+}
+
+func TestHealthCheckHandler(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression))
+	router.GET("/healthz", HealthCheckHandler)
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/healthz", nil).Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+	assert.Equal(t, "ok", string(w.Body()))
+}
+
+func TestRouteStats(t *testing.T) {
+	stats := &RouteStats{}
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithRouteStats(stats), WithExcludedPaths([]string{"/metrics"})))
+	router.GET("/user/:id", func(ctx context.Context, c *app.RequestContext) {
+		c.String(http.StatusOK, testResponse)
+	})
+	router.GET("/metrics", func(ctx context.Context, c *app.RequestContext) {
+		c.String(http.StatusOK, testResponse)
+	})
+
+	for _, path := range []string{"/user/1", "/user/2", "/metrics"} {
+		ut.PerformRequest(router, consts.MethodGet, path, nil, ut.Header{Key: "Accept-Encoding", Value: "deflate"})
+	}
+	ut.PerformRequest(router, consts.MethodGet, "/user/3", nil)
+
+	snapshot := stats.Snapshot()
+	assert.Equal(t, RouteCounts{Compressed: 2, Skipped: 1}, snapshot["/user/:id"])
+	assert.Equal(t, RouteCounts{Skipped: 1}, snapshot["/metrics"])
+	assert.Equal(t, float64(1), snapshot["/metrics"].SkipRatio())
+}
+
+func TestPolicyFn(t *testing.T) {
+	body := strings.Repeat("tenant policy ", 100)
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(func(ctx context.Context, c *app.RequestContext) {
+		c.Set("tenant", string(c.Request.Header.Peek("X-Tenant")))
+	})
+	router.Use(Deflate(DefaultCompression, WithPolicyFn(func(c *app.RequestContext) Policy {
+		switch c.GetString("tenant") {
+		case "free":
+			return Policy{Disable: true}
+		case "gold":
+			return Policy{Level: BestSpeed, SetLevel: true}
+		case "edge":
+			return Policy{Codec: "br"}
+		}
+		return Policy{}
+	})))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(http.StatusOK, body)
+	})
+
+	perform := func(tenant string) *protocol.Response {
+		return ut.PerformRequest(router, consts.MethodGet, "/", nil,
+			ut.Header{Key: "Accept-Encoding", Value: "deflate"},
+			ut.Header{Key: "X-Tenant", Value: tenant}).Result()
+	}
+	assert.Equal(t, "deflate", perform("").Header.Get("Content-Encoding"))
+	assert.Equal(t, "", perform("free").Header.Get("Content-Encoding"))
+	assert.Equal(t, "", perform("edge").Header.Get("Content-Encoding"))
+
+	w := perform("gold")
+	expected, _ := compress.AppendDeflateBytesLevel(nil, []byte(body), BestSpeed)
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, string(expected), string(w.Body()))
+}
+
+func TestKeepOriginalBody(t *testing.T) {
+	var original []byte
+	var kept bool
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(func(ctx context.Context, c *app.RequestContext) {
+		c.Next(ctx)
+		original, kept = OriginalBody(c)
+	})
+	router.Use(Deflate(DefaultCompression, WithKeepOriginalBody()))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(http.StatusOK, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{Key: "Accept-Encoding", Value: "deflate"}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	assert.True(t, kept)
+	assert.Equal(t, testResponse, string(original))
+
+	ut.PerformRequest(router, consts.MethodGet, "/", nil)
+	assert.False(t, kept)
+}
+
+func TestCompressedBodyHook(t *testing.T) {
+	key := []byte("secret")
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithCompressedBodyHook(func(c *app.RequestContext, body []byte) {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(body)
+		c.Response.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	})))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(http.StatusOK, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{Key: "Accept-Encoding", Value: "deflate"}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(w.Body())
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), w.Header.Get("X-Signature"))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil).Result()
+	assert.Equal(t, "", w.Header.Get("X-Signature"))
+}
+
+func TestConsumeAcceptEncoding(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithConsumeAcceptEncoding(), WithLegacyEncodings()))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(http.StatusOK, "upstream Accept-Encoding: "+c.Request.Header.Get("Accept-Encoding"))
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{Key: "Accept-Encoding", Value: "x-deflate"}).Result()
+	assert.Equal(t, "x-deflate", w.Header.Get("Content-Encoding"))
+	inflated, err := compress.AppendInflateBytes(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, "upstream Accept-Encoding: ", string(inflated))
+}
+
+func TestLenientDecompression(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithDecompressFn(DefaultDecompressHandle), WithLenientDecompression()))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(http.StatusOK, "%t %s", c.GetBool(MislabeledBodyKey), c.Request.Body())
+	})
+
+	w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: strings.NewReader(testResponse), Len: len(testResponse)},
+		ut.Header{Key: "Content-Encoding", Value: "deflate"}).Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+	assert.Equal(t, "true "+testResponse, string(w.Body()))
+
+	compressed, _ := compress.AppendDeflateBytesLevel(nil, []byte(testResponse), DefaultCompression)
+	w = ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(compressed), Len: len(compressed)},
+		ut.Header{Key: "Content-Encoding", Value: "deflate"}).Result()
+	assert.Equal(t, "false "+testResponse, string(w.Body()))
+}
+
+func TestExcludedPathsTrie(t *testing.T) {
+	var paths []string
+	for i := 0; i < 2*pathTrieThreshold; i++ {
+		paths = append(paths, fmt.Sprintf("/api/v%d/", i))
+	}
+	paths = append(paths, "/static")
+	excluded := NewExcludedPaths(paths)
+	trie := compilePaths(excluded)
+	assert.NotNil(t, trie)
+	assert.Nil(t, compilePaths(excluded[:pathTrieThreshold]))
+
+	for _, uri := range []string{"/", "/api/", "/api/v1", "/api/v1/", "/api/v12/books", "/api/v99/books", "/static", "/static/app.js", "/stat"} {
+		assert.Equal(t, excluded.Contains(uri), trie.contains(uri), uri)
+		assert.Equal(t, excluded.Contains(uri), excludesPath(excluded, trie, uri), uri)
+	}
+	// a trie compiled from other paths is ignored
+	assert.False(t, excludesPath(NewExcludedPaths([]string{"/other/"}), trie, "/static"))
+
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithExcludedPaths(paths)))
+	router.GET("/api/v40/books", func(ctx context.Context, c *app.RequestContext) {
 		c.String(200, "this is books!")
 	})
-	request := ut.PerformRequest(router, consts.MethodGet, "/api/books", nil, ut.Header{
+	w := ut.PerformRequest(router, consts.MethodGet, "/api/v40/books", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "this is books!", string(w.Body()))
+}
+
+func BenchmarkExcludedPaths(b *testing.B) {
+	var paths []string
+	for i := 0; i < 500; i++ {
+		paths = append(paths, fmt.Sprintf("/api/v%d/", i))
+	}
+	excluded := NewExcludedPaths(paths)
+	trie := compilePaths(excluded)
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			excluded.Contains("/books/1")
+		}
+	})
+	b.Run("trie", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			trie.contains("/books/1")
+		}
+	})
+}
+
+func TestIncludedMethodsForClient(t *testing.T) {
+	middleware := NewDeflateClientMiddleware(DefaultCompression, WithIncludedMethodsForClient([]string{"post", "PUT", "PATCH"}))
+	for method, expected := range map[string]bool{
+		consts.MethodPost:   true,
+		consts.MethodPut:    true,
+		consts.MethodPatch:  true,
+		consts.MethodGet:    false,
+		consts.MethodDelete: false,
+	} {
+		req := protocol.AcquireRequest()
+		req.SetMethod(method)
+		req.SetRequestURI("http://127.0.0.1/books")
+		req.SetBodyString("body")
+		assert.Equal(t, expected, middleware.ShouldCompress(req), method)
+	}
+
+	req := protocol.AcquireRequest()
+	req.SetBodyString("body")
+	req.SetRequestURI("http://127.0.0.1/books")
+	assert.True(t, NewDeflateClientMiddleware(DefaultCompression).ShouldCompress(req))
+}
+
+func TestDecompressMultipartForm(t *testing.T) {
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	_ = mw.WriteField("name", "books")
+	fw, _ := mw.CreateFormFile("file", "books.txt")
+	large := strings.Repeat(testResponse, 4096)
+	_, _ = fw.Write([]byte(large))
+	_ = mw.Close()
+	buf, _ := compress.AppendDeflateBytesLevel(nil, form.Bytes(), DefaultCompression)
+
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithDecompressFn(DefaultDecompressHandle)))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		// the inflated form is read from a stream by the multipart reader
+		streamed := c.Request.IsBodyStream()
+		f, err := c.MultipartForm()
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		file, err := f.File["file"][0].Open()
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer file.Close()
+		data, _ := io.ReadAll(file)
+		c.String(http.StatusOK, "%t %s %t", streamed, f.Value["name"][0], string(data) == large)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(buf), Len: len(buf)},
+		ut.Header{Key: "Content-Encoding", Value: "deflate"},
+		ut.Header{Key: "Content-Type", Value: mw.FormDataContentType()}).Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+	assert.Equal(t, "true books true", string(w.Body()))
+}
+
+func TestHTTP2Requests(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(func(ctx context.Context, c *app.RequestContext) {
+		c.Request.Header.SetProtocol(consts.HTTP20)
+	}, Deflate(DefaultCompression, WithFinalWriter()))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	// Connection is hop-by-hop, it has no meaning over HTTP/2
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "deflate"},
+		ut.Header{Key: "Connection", Value: "upgrade"}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	inflated, err := compress.AppendInflateBytes(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(inflated))
+
+	req := protocol.AcquireRequest()
+	req.Header.SetProtocol(consts.HTTP20)
+	req.Header.Set("Accept-Encoding", "deflate")
+	req.SetRequestURI("/")
+	req.SetMethod(consts.MethodConnect)
+	ok, reason := ShouldCompress(DefaultOptions, req)
+	assert.False(t, ok)
+	assert.Equal(t, ReasonExcludedMethod, reason)
+	// an extended CONNECT is a stream even when CONNECT isn't excluded
+	opts := *DefaultOptions
+	WithExcludedMethods(nil)(&opts)
+	ok, reason = ShouldCompress(&opts, req)
+	assert.False(t, ok)
+	assert.Equal(t, ReasonStreaming, reason)
+}
+
+func TestHandlerOptOut(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression))
+	router.GET("/identity", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("Content-Encoding", "identity")
+		c.String(200, testResponse)
+	})
+	router.GET("/skip", func(ctx context.Context, c *app.RequestContext) {
+		c.Set(SkipKey, true)
+		c.String(200, testResponse)
+	})
+
+	for _, path := range []string{"/identity", "/skip"} {
+		w := ut.PerformRequest(router, consts.MethodGet, path, nil,
+			ut.Header{Key: "Accept-Encoding", Value: "deflate"}).Result()
+		assert.Equal(t, http.StatusOK, w.StatusCode())
+		assert.Nil(t, w.Header.Peek("Content-Encoding"), path)
+		assert.Equal(t, testResponse, string(w.Body()))
+	}
+}
+
+func TestGroup(t *testing.T) {
+	group := NewGroup(DefaultCompression, WithExcludedPaths([]string{"/api/raw"}))
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	api := router.Group("/api", group.Handler())
+	api.GET("/books", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	api.GET("/raw", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	static := router.Group("/static", group.HandlerWith(WithExcludedExtensions([]string{".txt"})))
+	static.GET("/books.txt", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	static.GET("/books.html", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	for path, encoding := range map[string]string{
+		"/api/books":         "deflate",
+		"/api/raw":           "",
+		"/static/books.txt":  "",
+		"/static/books.html": "deflate",
+	} {
+		w := ut.PerformRequest(router, consts.MethodGet, path, nil,
+			ut.Header{Key: "Accept-Encoding", Value: "deflate"}).Result()
+		assert.Equal(t, encoding, w.Header.Get("Content-Encoding"), path)
+	}
+	stats := group.Stats().Snapshot()
+	assert.Equal(t, RouteCounts{Compressed: 1}, stats["/api/books"])
+	assert.Equal(t, RouteCounts{Skipped: 1}, stats["/static/books.txt"])
+	assert.Equal(t, 4, len(stats))
+}
+
+func TestPools(t *testing.T) {
+	pools := compress.NewPools()
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithPools(pools)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	for i := 0; i < 2; i++ {
+		w := ut.PerformRequest(router, consts.MethodGet, "/", nil,
+			ut.Header{Key: "Accept-Encoding", Value: "deflate"}).Result()
+		assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+		inflated, err := pools.AppendInflateBytes(nil, w.Body())
+		assert.Nil(t, err)
+		assert.Equal(t, testResponse, string(inflated))
+	}
+
+	req := protocol.AcquireRequest()
+	req.SetBodyString(testResponse)
+	NewDeflateClientMiddleware(DefaultCompression, WithPoolsForClient(pools)).compressRequest(req)
+	inflated, err := compress.AppendInflateBytes(nil, req.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(inflated))
+}
+
+func TestClientMemoryBudgetHeaders(t *testing.T) {
+	req := protocol.AcquireRequest()
+	req.SetBodyString(testResponse)
+	d := NewDeflateClientMiddleware(DefaultCompression, WithMemoryBudgetForClient(NewMemoryBudget(1)))
+	_, _, compressed := d.compressRequest(req)
+	assert.False(t, compressed)
+	assert.Equal(t, testResponse, string(req.Body()))
+	assert.Equal(t, "", req.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", req.Header.Get("Vary"))
+}
+
+func TestRPCDefaults(t *testing.T) {
+	large := strings.Repeat(testResponse, 50)
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithRPCDefaults()))
+	for path, contentType := range map[string]string{
+		"/json":   "application/json; charset=utf-8",
+		"/pb":     "application/x-protobuf",
+		"/thrift": "application/x-thrift",
+		"/png":    "image/png",
+		"/text":   "text/plain",
+	} {
+		contentType := contentType
+		router.GET(path, func(ctx context.Context, c *app.RequestContext) {
+			c.Data(200, contentType, []byte(large))
+		})
+	}
+	router.GET("/small", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "application/json", []byte(testResponse))
+	})
+
+	for path, encoding := range map[string]string{
+		"/json":   "deflate",
+		"/pb":     "deflate",
+		"/thrift": "deflate",
+		"/png":    "",
+		"/text":   "",
+		"/small":  "",
+	} {
+		w := ut.PerformRequest(router, consts.MethodGet, path, nil,
+			ut.Header{Key: "Accept-Encoding", Value: "deflate"}).Result()
+		assert.Equal(t, encoding, w.Header.Get("Content-Encoding"), path)
+		if encoding != "" {
+			// compressed at BestSpeed
+			expected, _ := compress.AppendDeflateBytesLevel(nil, []byte(large), BestSpeed)
+			assert.Equal(t, expected, w.Body(), path)
+		}
+	}
+}
+
+func TestEncodingTokensCache(t *testing.T) {
+	header := "deflate;q=0.5, gzip, *;q=0"
+	tokens := parseEncodingTokens(header)
+	cached, ok := encodingTokensCache.get(header)
+	assert.True(t, ok)
+	assert.Equal(t, tokens, cached)
+	assert.Equal(t, []encodingToken{{"deflate", 0.5}, {"gzip", 1}, {"*", 0}}, parseEncodingTokens(header))
+
+	// a full cache starts over
+	cache := newTokensCache(2)
+	cache.add("a", nil)
+	cache.add("b", nil)
+	cache.add("a", nil)
+	_, ok = cache.get("b")
+	assert.True(t, ok)
+	cache.add("c", nil)
+	_, ok = cache.get("a")
+	assert.False(t, ok)
+	_, ok = cache.get("c")
+	assert.True(t, ok)
+
+	accept := "text/event-stream;q=0.9, text/html"
+	assert.True(t, acceptsMediaType(accept, "text/event-stream"))
+	_, ok = encodingTokensCache.get(accept)
+	assert.False(t, ok)
+}
+
+func BenchmarkParseEncodingTokens(b *testing.B) {
+	header := "gzip, deflate, br;q=0.9, zstd;q=0.8"
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			parseEncodingTokens(header)
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			splitEncodingTokens(header)
+		}
+	})
+}
+
+func BenchmarkParseEncodingTokensParallel(b *testing.B) {
+	headers := []string{
+		"gzip, deflate, br;q=0.9, zstd;q=0.8",
+		"gzip, deflate, br",
+		"deflate",
+		"gzip, deflate",
+	}
+	b.Run("cached", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				parseEncodingTokens(headers[i%len(headers)])
+			}
+		})
+	})
+	b.Run("uncached", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				splitEncodingTokens(headers[i%len(headers)])
+			}
+		})
+	})
+}
+
+func TestVariantHook(t *testing.T) {
+	var variants []Variant
+	middleware := NewDeflateSrvMiddleware(DefaultCompression, WithLegacyEncodings(),
+		WithVariantHook(func(c *app.RequestContext, v Variant) {
+			variants = append(variants, v)
+		}))
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(middleware.SrvMiddleware)
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	for _, header := range []string{"gzip, deflate", "deflate;q=0.5, br", "x-deflate", "gzip", "*;q=0"} {
+		ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{Key: "Accept-Encoding", Value: header})
+		assert.Equal(t, middleware.CurrentOptions().VariantKey(header), variants[len(variants)-1].Key)
+	}
+	assert.Equal(t, []Variant{
+		{Key: "deflate", Encoding: "deflate"},
+		{Key: "deflate", Encoding: "deflate"},
+		{Key: "x-deflate", Encoding: "x-deflate"},
+		{Key: "identity", Encoding: "identity"},
+		{Key: "identity", Encoding: "identity"},
+	}, variants)
+}
+
+func TestExcludedMethods(t *testing.T) {
+	handler := func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	}
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression))
+	router.OPTIONS("/books", handler)
+	router.Handle(consts.MethodConnect, "/books", handler)
+	router.GET("/books", handler)
+
+	for method, encoding := range map[string]string{
+		consts.MethodOptions: "",
+		consts.MethodConnect: "",
+		consts.MethodGet:     "deflate",
+	} {
+		w := ut.PerformRequest(router, method, "/books", nil,
+			ut.Header{Key: "Accept-Encoding", Value: "deflate"}).Result()
+		assert.Equal(t, encoding, string(w.Header.Peek("Content-Encoding")), method)
+		if encoding == "" {
+			assert.Nil(t, w.Header.Peek("Vary"), method)
+		}
+	}
+
+	router = route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithExcludedMethods(nil)))
+	router.OPTIONS("/books", handler)
+	w := ut.PerformRequest(router, consts.MethodOptions, "/books", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "deflate"}).Result()
+	assert.Equal(t, "deflate", string(w.Header.Peek("Content-Encoding")))
+}
+
+func TestExplicitIdentity(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithExplicitIdentity(), WithExcludedPaths([]string{"/raw"})))
+	router.GET("/books", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	router.GET("/raw", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	router.GET("/gzip", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("Content-Encoding", "gzip")
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/books", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "gzip"}).Result()
+	assert.Equal(t, "identity", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header.Get("Vary"))
+	assert.Equal(t, testResponse, string(w.Body()))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/books", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "deflate"}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+
+	// skipped for another reason than the negotiation
+	w = ut.PerformRequest(router, consts.MethodGet, "/raw", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "deflate"}).Result()
+	assert.Nil(t, w.Header.Peek("Content-Encoding"))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/gzip", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "gzip"}).Result()
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+}
+
+func TestSuiteDecompressionLimit(t *testing.T) {
+	buf, _ := compress.AppendDeflateBytesLevel(nil, []byte(testResponse), DefaultCompression)
+	release := make(chan struct{})
+	decompressing := make(chan struct{})
+	srvMiddleware, _ := NewSuite(DefaultCompression,
+		WithSuiteOptions(WithMaxConcurrentDecompressions(1), nil),
+		WithSuiteOptions(WithDecompressFn(func(ctx context.Context, c *app.RequestContext) {
+			if c.Request.Header.Get("X-Block") != "" {
+				close(decompressing)
+				<-release
+			}
+			DefaultDecompressHandle(ctx, c)
+		}), nil))
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(srvMiddleware)
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "text/plain", c.GetRawData())
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(buf), Len: len(buf)},
+			ut.Header{Key: "Content-Encoding", Value: "deflate"}, ut.Header{Key: "X-Block", Value: "1"}).Result()
+		assert.Equal(t, http.StatusOK, w.StatusCode())
+	}()
+	<-decompressing
+
+	w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(buf), Len: len(buf)},
+		ut.Header{Key: "Content-Encoding", Value: "deflate"}).Result()
+	assert.Equal(t, http.StatusServiceUnavailable, w.StatusCode())
+	close(release)
+	<-done
+}
+
+func TestLegacyEncodings(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithLegacyEncodings()))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "x-gzip, x-deflate",
+	}).Result()
+	assert.Equal(t, "x-deflate", w.Header.Get("Content-Encoding"))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "x-deflate, deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+
+	w = ut.PerformRequest(newServer(), consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "x-deflate",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	supported := []string{"deflate", "gzip", "identity"}
+	for header, expected := range map[string]string{
+		"deflate, gzip":           "deflate",
+		"gzip, deflate;q=0.5":     "gzip",
+		"GZIP;q=0.8, *;q=0.9":     "deflate",
+		"br":                      "identity",
+		"":                        "identity",
+		strings.Repeat("a,", 600): "identity",
+	} {
+		encoding, ok := NegotiateEncoding(header, supported)
+		assert.True(t, ok, header)
+		assert.Equal(t, expected, encoding, header)
+	}
+
+	encoding, ok := NegotiateEncoding("br, identity;q=0", []string{"Deflate", "identity"})
+	assert.False(t, ok)
+	assert.Equal(t, "", encoding)
+	encoding, _ = NegotiateEncoding("deflate", []string{"Deflate"})
+	assert.Equal(t, "deflate", encoding)
+
+	// consistent with the middleware
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	for _, header := range []string{"deflate;q=0.1, gzip", "deflate;q=0, *", "*", "br"} {
+		w := ut.PerformRequest(router, consts.MethodGet, "/", nil,
+			ut.Header{Key: "Accept-Encoding", Value: header}).Result()
+		encoding, _ = NegotiateEncoding(header, []string{"deflate", "identity"})
+		if encoding == "identity" {
+			encoding = ""
+		}
+		assert.Equal(t, encoding, w.Header.Get("Content-Encoding"), header)
+	}
+}
+
+func TestEncodingPriority(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithEncodingPriority([]string{"br", "identity", "deflate"})))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate, identity",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate, identity;q=0.5",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+}
+
+func TestHeaderLimits(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithHeaderLimits(64, 4)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	for header, expected := range map[string]string{
+		"gzip, br, deflate":                     "deflate",
+		"a, b, c, d, deflate":                   "",
+		strings.Repeat(" ", 64) + "deflate":     "",
+		strings.Repeat("x", 4096) + ", deflate": "",
+	} {
+		w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+			Key: "Accept-Encoding", Value: header,
+		}).Result()
+		assert.Equal(t, expected, w.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestDeflatePNG(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression))
+	router.GET("/image.png", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, "this is a PNG!")
+	})
+	request := ut.PerformRequest(router, consts.MethodGet, "/image.png", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	})
+	w := request.Result()
+	assert.Equal(t, w.StatusCode(), 200)
+	assert.Equal(t, w.Header.Get("Content-Encoding"), "")
+	assert.Equal(t, w.Header.Get("Vary"), "")
+	assert.Equal(t, string(w.Body()), "this is a PNG!")
+}
+
+func TestExcludedExtensions(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithExcludedExtensions([]string{".html"})))
+	router.GET("/index.html", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, "this is a HTML!")
+	})
+	request := ut.PerformRequest(router, consts.MethodGet, "/index.html", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	})
+	w := request.Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", w.Header.Get("Vary"))
+	assert.Equal(t, "this is a HTML!", string(w.Body()))
+	assert.Equal(t, "15", w.Header.Get("Content-Length"))
+}
+
+func TestExcludedPaths(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithExcludedPaths([]string{"/api/"})))
+	router.GET("/api/books", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, "this is books!")
+	})
+	request := ut.PerformRequest(router, consts.MethodGet, "/api/books", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	})
+	w := request.Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", w.Header.Get("Vary"))
+	assert.Equal(t, "this is books!", string(w.Body()))
+	assert.Equal(t, "14", w.Header.Get("Content-Length"))
+}
+
+func TestAdaptiveLevel(t *testing.T) {
+	large := strings.Repeat(testResponse, 4096)
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(NoCompression, WithAdaptiveLevel()))
+	router.GET("/small", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	router.GET("/large", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, large)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/small", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	expected, _ := compress.AppendDeflateBytesLevel(nil, []byte(testResponse), BestSpeed)
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, expected, w.Body())
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/large", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	expected, _ = compress.AppendDeflateBytesLevel(nil, []byte(large), BestCompression)
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, expected, w.Body())
+}
+
+func TestLoadShedder(t *testing.T) {
+	overloaded := true
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithLoadShedder(func() bool { return overloaded })))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(w.Body()))
+
+	overloaded = false
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+}
+
+func TestEntropyThreshold(t *testing.T) {
+	random := make([]byte, 8<<10)
+	_, _ = rand.New(rand.NewSource(1)).Read(random)
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithEntropyThreshold(DefaultEntropyThreshold)))
+	router.GET("/blob", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "application/octet-stream", random)
+	})
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/blob", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, random, w.Body())
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+}
+
+func TestContentTypeSniffing(t *testing.T) {
+	png := append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), bytes.Repeat([]byte{0}, 64)...)
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithContentTypeSniffing()))
+	router.GET("/avatar", func(ctx context.Context, c *app.RequestContext) {
+		c.Response.SetBody(png)
+	})
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Response.SetBody([]byte(testResponse))
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/avatar", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, png, w.Body())
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+}
+
+func TestLevelContextKey(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(BestCompression))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Set(LevelContextKey, NoCompression)
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	expected, _ := compress.AppendDeflateBytesLevel(nil, []byte(testResponse), NoCompression)
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, expected, w.Body())
+}
+
+func TestMemoryBudget(t *testing.T) {
+	budget := NewMemoryBudget(64)
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithMemoryBudget(budget)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	router.GET("/large", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, strings.Repeat(testResponse, 4))
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/large", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, strings.Repeat(testResponse, 4), string(w.Body()))
+	assert.Equal(t, int64(0), budget.InUse())
+}
+
+func TestMemoryBudgetHeldUntilSent(t *testing.T) {
+	budget := NewMemoryBudget(2 * int64(len(testResponse)))
+	release := make(chan struct{})
+	compressed := make(chan struct{})
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	// holds the response after the deflate middleware returned, before it is sent
+	router.Use(func(ctx context.Context, c *app.RequestContext) {
+		c.Next(ctx)
+		if c.Request.Header.Get("X-Block") != "" {
+			close(compressed)
+			<-release
+		}
+	})
+	router.Use(Deflate(DefaultCompression, WithMemoryBudget(budget)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := ut.PerformRequest(router, consts.MethodGet, "/", nil,
+			ut.Header{Key: "Accept-Encoding", Value: "deflate"}, ut.Header{Key: "X-Block", Value: "1"}).Result()
+		assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	}()
+	<-compressed
+	assert.Equal(t, 2*int64(len(testResponse)), budget.InUse())
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	close(release)
+	<-done
+	assert.Equal(t, int64(0), budget.InUse())
+
+	// the client holds its reservation until the request is sent
+	var inUse int64
+	endpoint := NewDeflateClientMiddleware(DefaultCompression, WithMemoryBudgetForClient(budget)).ClientMiddleware(
+		func(ctx context.Context, req *protocol.Request, resp *protocol.Response) error {
+			inUse = budget.InUse()
+			return nil
+		})
+	req := protocol.AcquireRequest()
+	req.SetMethod(consts.MethodPost)
+	req.SetBodyString(testResponse)
+	assert.Nil(t, endpoint(context.Background(), req, protocol.AcquireResponse()))
+	assert.Equal(t, 2*int64(len(testResponse)), inUse)
+	assert.Equal(t, int64(0), budget.InUse())
+}
+
+func TestHuffmanOnly(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(HuffmanOnly))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	inflated, err := compress.AppendInflateBytes(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(inflated))
+}
+
+func TestNewWithConfig(t *testing.T) {
+	_, err := New(Config{Level: 42})
+	assert.NotNil(t, err)
+	_, err = New(Config{Level: DefaultCompression, ExcludedPathRegexes: []string{"("}})
+	assert.NotNil(t, err)
+	_, err = New(Config{Level: DefaultCompression, ExcludedExtensions: []string{"html"}})
+	assert.NotNil(t, err)
+
+	handler, err := New(Config{Level: DefaultCompression, ExcludedPaths: []string{"/api/"}})
+	assert.Nil(t, err)
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(handler)
+	router.GET("/api/books", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, "this is books!")
+	})
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/api/books", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+}
+
+func TestConfigConflicts(t *testing.T) {
+	for _, cfg := range []Config{
+		{Level: DefaultCompression, MinSize: 1024, MaxSize: 512},
+		{Level: DefaultCompression, EncodingPriority: []string{"br", "identity"}},
+		{Level: DefaultCompression, IncludedContentTypes: []string{"json"}},
+	} {
+		assert.NotNil(t, cfg.Validate(), cfg)
+	}
+	assert.Nil(t, Config{Level: DefaultCompression, MinSize: 512}.Validate())
+	assert.Nil(t, Config{Level: DefaultCompression, EncodingPriority: []string{"identity", "Deflate"}}.Validate())
+
+	handler, err := New(Config{
+		Level:                DefaultCompression,
+		MinSize:              64,
+		IncludedContentTypes: []string{"application/json"},
+		ExcludedMethods:      []string{},
+	}, WithOriginalLengthHeader())
+	assert.Nil(t, err)
+	body := []byte(strings.Repeat(`{"title":"books"}`, 8))
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(handler)
+	router.OPTIONS("/json", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "application/json", body)
+	})
+	router.GET("/json", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "application/json", body)
+	})
+	router.GET("/small", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "application/json", []byte("{}"))
+	})
+	router.GET("/text", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, string(body))
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/json", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(body)), w.Header.Get(HeaderOriginalContentLength))
+	for _, path := range []string{"/small", "/text"} {
+		w = ut.PerformRequest(router, consts.MethodGet, path, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "deflate",
+		}).Result()
+		assert.Equal(t, "", w.Header.Get("Content-Encoding"), path)
+	}
+	// OPTIONS is among DefaultExcludedMethods
+	w = ut.PerformRequest(router, consts.MethodOptions, "/json", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+}
+
+func TestConfigDefaultLevel(t *testing.T) {
+	var cfg Config
+	assert.Nil(t, yaml.Unmarshal([]byte("excluded_paths: [/api/]"), &cfg))
+	assert.Equal(t, DefaultCompression, cfg.Level)
+	assert.Equal(t, []string{"/api/"}, cfg.ExcludedPaths)
+	assert.Nil(t, yaml.Unmarshal([]byte("level: 0"), &cfg))
+	assert.Equal(t, NoCompression, cfg.Level)
+
+	var clientCfg ClientConfig
+	assert.Nil(t, yaml.Unmarshal([]byte("adaptive_level: true"), &clientCfg))
+	assert.Equal(t, DefaultCompression, clientCfg.Level)
+	assert.True(t, clientCfg.AdaptiveLevel)
+}
+
+func TestFromConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deflate.yaml")
+	err := os.WriteFile(path, []byte(`
+server:
+  level: 9
+  excluded_paths: ["/api/"]
+  etag_policy: weaken
+  integrity_policy: recompute
+  decompress: streaming
+  memory_budget: 1048576
+  min_size: 256
+  excluded_methods: [HEAD]
+client:
+  adaptive_level: true
+  decompress: true
+`), 0o600)
+	assert.Nil(t, err)
+
+	cfg, clientCfg, err := FromConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, BestCompression, cfg.Level)
+	assert.Equal(t, []string{"/api/"}, cfg.ExcludedPaths)
+	assert.Nil(t, cfg.ExcludedExtensions)
+	assert.Equal(t, ETagWeaken, cfg.ETagPolicy)
+	assert.Equal(t, IntegrityRecompute, cfg.IntegrityPolicy)
+	assert.NotNil(t, cfg.DecompressFn)
+	assert.Equal(t, int64(0), cfg.MemoryBudget.InUse())
+	assert.Equal(t, 256, cfg.MinSize)
+	assert.Equal(t, []string{"HEAD"}, cfg.ExcludedMethods)
+	assert.Equal(t, DefaultCompression, clientCfg.Level)
+	assert.True(t, clientCfg.AdaptiveLevel)
+	assert.NotNil(t, clientCfg.DecompressFnForClient)
+
+	t.Setenv("DEFLATE_TEST_CONFIG", `{"server": {"level": 1, "excluded_extensions": [".zip"]}}`)
+	cfg, _, err = FromConfig("env:DEFLATE_TEST_CONFIG")
+	assert.Nil(t, err)
+	assert.Equal(t, BestSpeed, cfg.Level)
+	assert.Equal(t, []string{".zip"}, cfg.ExcludedExtensions)
+	_, err = New(cfg)
+	assert.Nil(t, err)
+
+	for _, doc := range []string{
+		`{"server": {"level": 42}}`,
+		`{"server": {"etag_policy": "strong"}}`,
+		`{"server": {"decompress": "eager"}}`,
+		`{"client": {"excluded_path_regexes": ["("]}}`,
+		`{"server": {"min_size": 2048, "max_size": 1024}}`,
+	} {
+		t.Setenv("DEFLATE_TEST_CONFIG", doc)
+		_, _, err = FromConfig("env:DEFLATE_TEST_CONFIG")
+		assert.NotNil(t, err, doc)
+	}
+	_, _, err = FromConfig("env:DEFLATE_TEST_UNSET")
+	assert.NotNil(t, err)
+}
+
+func TestWithoutVaryHeader(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithoutVaryHeader()))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", w.Header.Get("Vary"))
+}
+
+func TestShouldCompressFunc(t *testing.T) {
+	middleware := NewDeflateSrvMiddleware(DefaultCompression)
+	middleware.ShouldCompressFunc = func(req *protocol.Request) bool {
+		return middleware.ShouldCompress(req) && req.Header.Get("X-No-Compression") == ""
+	}
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(middleware.SrvMiddleware)
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "deflate"},
+		ut.Header{Key: "X-No-Compression", Value: "1"},
+	).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+}
+
+func TestETagPolicy(t *testing.T) {
+	for policy, expected := range map[ETagPolicy]string{
+		ETagKeep:   `"v1"`,
+		ETagWeaken: `W/"v1"`,
+		ETagSuffix: `"v1-deflate"`,
+	} {
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(Deflate(DefaultCompression, WithETagPolicy(policy)))
+		router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+			c.Header("ETag", `"v1"`)
+			c.String(200, testResponse)
+		})
+		router.GET("/weak", func(ctx context.Context, c *app.RequestContext) {
+			c.Header("ETag", `W/"v1"`)
+			c.String(200, testResponse)
+		})
+
+		w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+			Key: "Accept-Encoding", Value: "deflate",
+		}).Result()
+		assert.Equal(t, expected, w.Header.Get("ETag"))
+
+		w = ut.PerformRequest(router, consts.MethodGet, "/weak", nil, ut.Header{
+			Key: "Accept-Encoding", Value: "deflate",
+		}).Result()
+		assert.Equal(t, `W/"v1"`, w.Header.Get("ETag"))
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	assert.Equal(t, `"v1"`, NormalizeETag(`W/"v1"`, ETagWeaken))
+	assert.Equal(t, `"v1"`, NormalizeETag(`"v1-deflate"`, ETagSuffix))
+	assert.Equal(t, `"v1"`, NormalizeETag(` W/"v1-deflate"`, ETagSuffix))
+	assert.Equal(t, `"v1-deflate"`, NormalizeETag(`"v1-deflate"`, ETagKeep))
+	assert.Equal(t, `"v1-deflate"`, NormalizeETag(`W/"v1-deflate"`, ETagWeaken))
+	assert.True(t, ETagMatches(`"v0", W/"v1"`, `"v1"`))
+	assert.True(t, ETagMatches(`"v1-deflate"`, `"v1"`))
+	assert.True(t, ETagMatches(`*`, `"v1"`))
+	assert.False(t, ETagMatches(`"v0", "v1-gzip"`, `"v1"`))
+	// an upstream ETag ending in -deflate
+	assert.False(t, ETagMatches(`"v1"`, `"v1-deflate"`))
+	assert.True(t, ETagMatches(`"v1-deflate"`, `"v1-deflate"`))
+	assert.True(t, ETagMatches(`"v1-deflate-deflate"`, `"v1-deflate"`))
+
+	for policy, expected := range map[ETagPolicy]string{
+		ETagKeep:   `"v1"`,
+		ETagWeaken: `W/"v1"`,
+		ETagSuffix: `"v1-deflate"`,
+	} {
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(Deflate(DefaultCompression, WithETagPolicy(policy)))
+		router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+			if NotModified(c, `"v1"`) {
+				return
+			}
+			c.Header("ETag", `"v1"`)
+			c.String(200, testResponse)
+		})
+
+		w := ut.PerformRequest(router, consts.MethodGet, "/", nil,
+			ut.Header{Key: "Accept-Encoding", Value: "deflate"}).Result()
+		assert.Equal(t, http.StatusOK, w.StatusCode())
+		etag := w.Header.Get("ETag")
+		assert.Equal(t, expected, etag)
+
+		w = ut.PerformRequest(router, consts.MethodGet, "/", nil,
+			ut.Header{Key: "Accept-Encoding", Value: "deflate"},
+			ut.Header{Key: "If-None-Match", Value: etag}).Result()
+		assert.Equal(t, http.StatusNotModified, w.StatusCode())
+		assert.Equal(t, expected, w.Header.Get("ETag"))
+
+		// the identity representation keeps the ETag of the handler
+		w = ut.PerformRequest(router, consts.MethodGet, "/", nil,
+			ut.Header{Key: "If-None-Match", Value: `"v1"`}).Result()
+		assert.Equal(t, http.StatusNotModified, w.StatusCode())
+		assert.Equal(t, `"v1"`, w.Header.Get("ETag"))
+	}
+
+	// a handler ETag ending in -deflate is compared as it is
+	for _, policy := range []ETagPolicy{ETagKeep, ETagWeaken, ETagSuffix} {
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(Deflate(DefaultCompression, WithETagPolicy(policy)))
+		router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+			if NotModified(c, `"v1-deflate"`) {
+				return
+			}
+			c.Header("ETag", `"v1-deflate"`)
+			c.String(200, testResponse)
+		})
+
+		w := ut.PerformRequest(router, consts.MethodGet, "/", nil,
+			ut.Header{Key: "Accept-Encoding", Value: "deflate"}).Result()
+		etag := w.Header.Get("ETag")
+		assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+		assert.Equal(t, `"v1-deflate"`, NormalizeETag(etag, policy), policy)
+
+		w = ut.PerformRequest(router, consts.MethodGet, "/", nil,
+			ut.Header{Key: "Accept-Encoding", Value: "deflate"},
+			ut.Header{Key: "If-None-Match", Value: etag}).Result()
+		assert.Equal(t, http.StatusNotModified, w.StatusCode(), policy)
+
+		w = ut.PerformRequest(router, consts.MethodGet, "/", nil,
+			ut.Header{Key: "Accept-Encoding", Value: "deflate"},
+			ut.Header{Key: "If-None-Match", Value: `"v1"`}).Result()
+		assert.Equal(t, http.StatusOK, w.StatusCode(), policy)
+	}
+}
+
+func TestIntegrityPolicy(t *testing.T) {
+	newRouter := func(policy IntegrityPolicy) *route.Engine {
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(Deflate(DefaultCompression, WithIntegrityPolicy(policy)))
+		router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+			c.Header("Content-MD5", "stale")
+			c.Header("Digest", "SHA-256=stale, unknown=stale")
+			c.Header("Repr-Digest", "sha-512=:stale:")
+			c.String(200, testResponse)
+		})
+		return router
+	}
+
+	w := ut.PerformRequest(newRouter(IntegrityDrop), consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-MD5"))
+	assert.Equal(t, "", w.Header.Get("Digest"))
+	assert.Equal(t, "", w.Header.Get("Repr-Digest"))
+
+	w = ut.PerformRequest(newRouter(IntegrityRecompute), consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	md5Sum := md5.Sum(w.Body())
+	sha256Sum := sha256.Sum256(w.Body())
+	sha512Sum := sha512.Sum512(w.Body())
+	assert.Equal(t, base64.StdEncoding.EncodeToString(md5Sum[:]), w.Header.Get("Content-MD5"))
+	assert.Equal(t, "SHA-256="+base64.StdEncoding.EncodeToString(sha256Sum[:]), w.Header.Get("Digest"))
+	assert.Equal(t, "sha-512=:"+base64.StdEncoding.EncodeToString(sha512Sum[:])+":", w.Header.Get("Repr-Digest"))
+
+	w = ut.PerformRequest(newRouter(IntegrityKeep), consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "stale", w.Header.Get("Content-MD5"))
+}
+
+func TestSecretAwareSkip(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithSecretAwareSkip(func(c *app.RequestContext) bool {
+		return c.GetBool("secret")
+	})))
+	router.GET("/token", func(ctx context.Context, c *app.RequestContext) {
+		c.Set("secret", true)
+		c.String(200, testResponse)
+	})
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/token", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(w.Body()))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+}
+
+func TestRandomPadding(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithRandomPadding(64)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	unpadded, _ := compress.AppendDeflateBytesLevelPadded(nil, []byte(testResponse), DefaultCompression, 0)
+	for i := 0; i < 10; i++ {
+		w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+			Key: "Accept-Encoding", Value: "deflate",
+		}).Result()
+		assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+		assert.LessOrEqual(t, len(w.Body()), len(unpadded)+64)
+		inflated, err := compress.AppendInflateBytes(nil, w.Body())
+		assert.Nil(t, err)
+		assert.Equal(t, testResponse, string(inflated))
+	}
+}
+
+func TestPadding(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithPadding(32), WithRandomPadding(16)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	for i := 0; i < 10; i++ {
+		w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+			Key: "Accept-Encoding", Value: "deflate",
+		}).Result()
+		assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+		assert.Equal(t, 0, len(w.Body())%32)
+		inflated, err := compress.AppendInflateBytes(nil, w.Body())
+		assert.Nil(t, err)
+		assert.Equal(t, testResponse, string(inflated))
+	}
+}
+
+func TestProxyMode(t *testing.T) {
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, _ = gw.Write([]byte(testResponse))
+	_ = gw.Close()
+	deflated, _ := compress.AppendDeflateBytesLevel(nil, []byte(testResponse), DefaultCompression)
+
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithProxyMode()))
+	router.GET("/gzip", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("Content-Encoding", "gzip")
+		c.Data(200, "text/plain", gzipped.Bytes())
+	})
+	router.GET("/deflate", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("Content-Encoding", "deflate")
+		c.Data(200, "text/plain", deflated)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/gzip", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "gzip, deflate",
+	}).Result()
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, gzipped.Bytes(), w.Body())
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/gzip", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	inflated, err := compress.AppendInflateBytes(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(inflated))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/deflate", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, deflated, w.Body())
+}
+
+func TestProxyModeLimits(t *testing.T) {
+	large := strings.Repeat("a", 128<<10)
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, _ = gw.Write([]byte(large))
+	_ = gw.Close()
+	get := func(opts ...Option) *protocol.Response {
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(Deflate(DefaultCompression, append(opts, WithProxyMode())...))
+		router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+			c.Header("Content-Encoding", "gzip")
+			c.Data(200, "text/plain", gzipped.Bytes())
+		})
+		return ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+			Key: "Accept-Encoding", Value: "deflate",
+		}).Result()
+	}
+
+	// the level is picked from the inflated size
+	w := get(WithAdaptiveLevel())
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	expected, _ := compress.AppendDeflateBytesLevel(nil, []byte(large), BestCompression)
+	assert.Equal(t, expected, w.Body())
+
+	w = get(WithInflateLimits(compress.InflateLimits{MaxSize: 1000}))
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, gzipped.Bytes(), w.Body())
+
+	w = get(WithMemoryBudget(NewMemoryBudget(1000)))
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, gzipped.Bytes(), w.Body())
+
+	w = get(WithExcludedSizeRange(0, 1000))
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, large, string(w.Body()))
+}
+
+func TestErrorHook(t *testing.T) {
+	var hookErr, chainErr error
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(func(ctx context.Context, c *app.RequestContext) {
+		c.Next(ctx)
+		if last := c.Errors.Last(); last != nil {
+			chainErr = last.Err
+		}
+	})
+	router.Use(Deflate(DefaultCompression, WithProxyMode(), WithErrorHook(func(c *app.RequestContext, err error) {
+		hookErr = err
+	})))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("Content-Encoding", "gzip")
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.NotNil(t, hookErr)
+	assert.Equal(t, hookErr, chainErr)
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", w.Header.Get("Vary"))
+	assert.Equal(t, testResponse, string(w.Body()))
+}
+
+func TestDoubleCompressionGuard(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression), Deflate(BestSpeed))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	router.GET("/gzip", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("Content-Encoding", "gzip")
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	inflated, err := compress.AppendInflateBytes(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(inflated))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/gzip", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(w.Body()))
+
+	c := app.NewContext(0)
+	assert.True(t, ClaimCompression(c))
+	assert.False(t, ClaimCompression(c))
+}
+
+func TestDeflateBodyStream(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.SetContentType("text/plain")
+		c.Response.SetBodyStream(strings.NewReader(testResponse), -1)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	inflated, err := compress.AppendInflateBytes(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(inflated))
+}
+
+func TestDeflateParallelCompression(t *testing.T) {
+	body := strings.Repeat("parallel compression of a large export\n", 100000)
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithParallelCompression(1<<20)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.SetContentType("text/plain")
+		c.Response.SetBodyStream(strings.NewReader(body), len(body))
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	inflated, err := compress.AppendInflateBytes(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, body, string(inflated))
+}
+
+// largestReadRecorder records the largest read of its Reader
+type largestReadRecorder struct {
+	io.Reader
+	largest int
+}
+
+func (r *largestReadRecorder) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.largest = max(r.largest, n)
+	return n, err
+}
+
+func TestStreamBufferSize(t *testing.T) {
+	body := strings.Repeat("slow client ", 10000)
+	stream := &largestReadRecorder{Reader: strings.NewReader(body)}
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithStreamBufferSize(1024)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.SetContentType("text/plain")
+		c.Response.SetBodyStream(stream, -1)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	inflated, err := compress.AppendInflateBytes(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, body, string(inflated))
+	assert.Equal(t, 1024, stream.largest)
+}
+
+type bufferExtWriter struct {
+	bytes.Buffer
+	flushes   int
+	finalized bool
+}
+
+func (w *bufferExtWriter) Flush() error {
+	w.flushes++
+	return nil
+}
+
+func (w *bufferExtWriter) Finalize() error {
+	w.finalized = true
+	return nil
+}
+
+func TestHijackWriter(t *testing.T) {
+	d := NewDeflateSrvMiddleware(DefaultCompression)
+	c := app.NewContext(0)
+	c.Request.Header.Set("Accept-Encoding", "deflate")
+	w := &bufferExtWriter{}
+	d.HijackWriter(c, w)
+	assert.Equal(t, "deflate", c.Response.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", c.Response.Header.Get("Vary"))
+
+	_, _ = c.Write([]byte("partial "))
+	assert.Nil(t, c.Flush())
+	assert.Equal(t, 1, w.flushes)
+	inflated, _ := io.ReadAll(flate.NewReader(bytes.NewReader(w.Bytes()[2:])))
+	assert.Equal(t, "partial ", string(inflated))
+
+	_, _ = c.Write([]byte(testResponse))
+	assert.Nil(t, c.Response.GetHijackWriter().Finalize())
+	assert.True(t, w.finalized)
+	inflated, err := compress.AppendInflateBytes(nil, w.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, "partial "+testResponse, string(inflated))
+
+	c = app.NewContext(0)
+	w = &bufferExtWriter{}
+	d.HijackWriter(c, w)
+	assert.Equal(t, "", c.Response.Header.Get("Content-Encoding"))
+	assert.Equal(t, network.ExtWriter(w), c.Response.GetHijackWriter())
+
+	// the options of the middleware apply
+	for _, opts := range [][]Option{
+		{WithExcludedPaths([]string{"/stream"})},
+		{WithRandomPadding(16)},
+	} {
+		c = app.NewContext(0)
+		c.Request.SetRequestURI("/stream")
+		c.Request.Header.Set("Accept-Encoding", "deflate")
+		w = &bufferExtWriter{}
+		NewDeflateSrvMiddleware(DefaultCompression, opts...).HijackWriter(c, w)
+		assert.Equal(t, "", c.Response.Header.Get("Content-Encoding"))
+		assert.Equal(t, network.ExtWriter(w), c.Response.GetHijackWriter())
+	}
+
+	c = app.NewContext(0)
+	c.Request.Header.Set("Accept-Encoding", "x-deflate")
+	NewDeflateSrvMiddleware(DefaultCompression, WithLegacyEncodings(), WithoutVaryHeader()).HijackWriter(c, &bufferExtWriter{})
+	assert.Equal(t, "x-deflate", c.Response.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", c.Response.Header.Get("Vary"))
+
+	c = app.NewContext(0)
+	c.Request.Header.Set("Accept-Encoding", "deflate")
+	c.Response.Header.Set("Vary", "Origin")
+	NewDeflateSrvMiddleware(DefaultCompression, WithCDNMode("X-Edge-Compressed")).HijackWriter(c, &bufferExtWriter{})
+	assert.Equal(t, "Origin, Accept-Encoding", c.Response.Header.Get("Vary"))
+}
+
+func TestHijackWriterChecks(t *testing.T) {
+	newContext := func() *app.RequestContext {
+		c := app.NewContext(0)
+		c.Request.SetRequestURI("/stream")
+		c.Request.Header.Set("Accept-Encoding", "deflate")
+		return c
+	}
+	skipped := func(c *app.RequestContext, opts ...Option) {
+		w := &bufferExtWriter{}
+		NewDeflateSrvMiddleware(DefaultCompression, opts...).HijackWriter(c, w)
+		assert.Equal(t, "", c.Response.Header.Get("Content-Encoding"))
+		assert.Equal(t, network.ExtWriter(w), c.Response.GetHijackWriter())
+	}
+
+	skipped(newContext(), WithPolicyFn(func(c *app.RequestContext) Policy {
+		return Policy{Disable: true}
+	}))
+
+	c := newContext()
+	c.Request.Header.Set("Range", "bytes=0-10")
+	skipped(c, WithCDNMode())
+	c = newContext()
+	c.Response.Header.Set("Cache-Control", "no-transform")
+	skipped(c, WithCDNMode())
+	c = newContext()
+	c.SetStatusCode(http.StatusPartialContent)
+	skipped(c, WithCDNMode())
+
+	// claimed by another middleware
+	c = newContext()
+	ClaimCompression(c)
+	skipped(c)
+
+	c = newContext()
+	c.Request.Header.Set("Accept-Encoding", "gzip")
+	w := &bufferExtWriter{}
+	NewDeflateSrvMiddleware(DefaultCompression, WithExplicitIdentity()).HijackWriter(c, w)
+	assert.Equal(t, "identity", c.Response.Header.Get("Content-Encoding"))
+	assert.Equal(t, network.ExtWriter(w), c.Response.GetHijackWriter())
+
+	// the claim of the middleware running the handler is its own
+	d := NewDeflateSrvMiddleware(DefaultCompression)
+	d.UpdateOptions(WithAdaptiveLevel())
+	c = newContext()
+	w = &bufferExtWriter{}
+	c.SetHandlers(app.HandlersChain{d.SrvMiddleware, func(ctx context.Context, c *app.RequestContext) {
+		d.HijackWriter(c, w)
+		_, _ = c.Write([]byte(testResponse))
+	}})
+	c.Next(context.Background())
+	assert.Equal(t, "deflate", c.Response.Header.Get("Content-Encoding"))
+	assert.Nil(t, c.Response.GetHijackWriter().Finalize())
+	inflated, err := compress.AppendInflateBytes(nil, w.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(inflated))
+}
+
+func TestCDNMode(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithCDNMode("X-Edge-Compressed")))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("Vary", "Origin")
+		c.String(200, testResponse)
+	})
+	router.GET("/no-transform", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("Cache-Control", "public, no-transform")
+		c.String(200, testResponse)
+	})
+	router.GET("/not-modified", func(ctx context.Context, c *app.RequestContext) {
+		c.Status(304)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}).Result()
+	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Origin, Accept-Encoding", w.Header.Get("Vary"))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
 		Key: "Accept-Encoding", Value: "deflate",
-	})
-	w := request.Result()
-	assert.Equal(t, http.StatusOK, w.StatusCode())
+	}, ut.Header{
+		Key: "Range", Value: "bytes=0-10",
+	}).Result()
 	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
-	assert.Equal(t, "", w.Header.Get("Vary"))
-	assert.Equal(t, "this is books!", string(w.Body()))
-	assert.Equal(t, "14", w.Header.Get("Content-Length"))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "deflate",
+	}, ut.Header{
+		Key: "X-Edge-Compressed", Value: "1",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(w.Body()))
+
+	for _, path := range []string{"/no-transform", "/not-modified"} {
+		w = ut.PerformRequest(router, consts.MethodGet, path, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "deflate",
+		}).Result()
+		assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	}
 }
 
 func TestNoDeflate(t *testing.T) {
@@ -181,12 +2268,29 @@ func TestDecompressDeflateWithSkipFunc(t *testing.T) {
 		ut.Header{Key: "Accept-Encoding", Value: "deflate"})
 	w := request.Result()
 	assert.Equal(t, http.StatusOK, w.StatusCode())
-	assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
-	assert.Equal(t, "Accept-Encoding", w.Header.Get("Vary"))
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", w.Header.Get("Vary"))
 	assert.Equal(t, "", string(w.Body()))
 	assert.Equal(t, "0", w.Header.Get("Content-Length"))
 }
 
+func TestDecompressMislabeledGzip(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithDecompressFn(DefaultDecompressHandle)))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, string(c.Request.Body()))
+	})
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, _ = gw.Write([]byte(testResponse))
+	_ = gw.Close()
+
+	w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: &gzipped, Len: gzipped.Len()},
+		ut.Header{Key: "Content-Encoding", Value: "deflate"}).Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+	assert.Equal(t, testResponse, string(w.Body()))
+}
+
 func TestDecompressDeflateWithIncorrectData(t *testing.T) {
 	router := route.NewEngine(config.NewOptions([]config.Option{}))
 	router.Use(Deflate(DefaultCompression, WithDecompressFn(DefaultDecompressHandle)))
@@ -200,6 +2304,154 @@ func TestDecompressDeflateWithIncorrectData(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, w.StatusCode())
 }
 
+func TestMaxConcurrentDecompressions(t *testing.T) {
+	buf, _ := compress.AppendDeflateBytesLevel(nil, []byte(testResponse), DefaultCompression)
+	release := make(chan struct{})
+	decompressing := make(chan struct{})
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression,
+		WithMaxConcurrentDecompressions(1),
+		WithDecompressionLimitStatus(http.StatusTooManyRequests),
+		WithDecompressFn(func(ctx context.Context, c *app.RequestContext) {
+			if c.Request.Header.Get("X-Block") != "" {
+				close(decompressing)
+				<-release
+			}
+			DefaultDecompressHandle(ctx, c)
+		})))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "text/plain", c.GetRawData())
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(buf), Len: len(buf)},
+			ut.Header{Key: "Content-Encoding", Value: "deflate"}, ut.Header{Key: "X-Block", Value: "1"}).Result()
+		assert.Equal(t, http.StatusOK, w.StatusCode())
+		assert.Equal(t, testResponse, string(w.Body()))
+	}()
+	<-decompressing
+
+	w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(buf), Len: len(buf)},
+		ut.Header{Key: "Content-Encoding", Value: "deflate"}).Result()
+	assert.Equal(t, http.StatusTooManyRequests, w.StatusCode())
+
+	close(release)
+	<-done
+	w = ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(buf), Len: len(buf)},
+		ut.Header{Key: "Content-Encoding", Value: "deflate"}).Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+}
+
+func TestMaxCompressedRequestSize(t *testing.T) {
+	buf, _ := compress.AppendDeflateBytesLevel(nil, []byte(strings.Repeat(testResponse, 20)), DefaultCompression)
+	mw := NewDeflateSrvMiddleware(DefaultCompression,
+		WithMaxCompressedRequestSize(len(buf)-1),
+		WithMaxConcurrentDecompressions(1),
+		WithDecompressFn(DefaultDecompressHandle))
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(mw.SrvMiddleware)
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "text/plain", c.GetRawData())
+	})
+
+	w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(buf), Len: len(buf)},
+		ut.Header{Key: "Content-Encoding", Value: "deflate"}).Result()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.StatusCode())
+	// identity bodies aren't bounded
+	w = ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(buf), Len: len(buf)}).Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+
+	var header protocol.RequestHeader
+	header.Set("Expect", "100-continue")
+	header.SetContentLength(len(buf) - 1)
+	assert.True(t, mw.ContinueHandler(&header))
+	header.Set("Content-Encoding", "deflate")
+	assert.True(t, mw.ContinueHandler(&header))
+	header.SetContentLength(len(buf))
+	assert.False(t, mw.ContinueHandler(&header))
+
+	header.SetContentLength(len(buf) - 1)
+	mw.decompressions <- struct{}{}
+	assert.False(t, mw.ContinueHandler(&header))
+	<-mw.decompressions
+	assert.True(t, mw.ContinueHandler(&header))
+}
+
+func TestStreamingDecompressHandle(t *testing.T) {
+	large := strings.Repeat(testResponse, 4096)
+	buf, _ := compress.AppendDeflateBytesLevel(nil, []byte(large), DefaultCompression)
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression, WithDecompressFn(StreamingDecompressHandle)))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		if v := c.Request.Header.Get("Content-Encoding"); v != "" {
+			t.Errorf("unexpected `Content-Encoding`: %s header", v)
+		}
+		data, err := io.ReadAll(c.Request.BodyStream())
+		if err != nil {
+			t.Error(err)
+		}
+		c.String(200, strconv.Itoa(len(data))+":"+strconv.FormatBool(string(data) == large))
+	})
+
+	for _, length := range []int{len(buf), -1} {
+		w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(buf), Len: length},
+			ut.Header{Key: "Content-Encoding", Value: "deflate"}).Result()
+		assert.Equal(t, http.StatusOK, w.StatusCode())
+		assert.Equal(t, strconv.Itoa(len(large))+":true", string(w.Body()))
+	}
+
+	reader := bytes.NewReader([]byte(testResponse))
+	w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: reader, Len: reader.Len()},
+		ut.Header{Key: "Content-Encoding", Value: "deflate"}).Result()
+	assert.Equal(t, http.StatusBadRequest, w.StatusCode())
+}
+
+func TestInflateLimits(t *testing.T) {
+	large := strings.Repeat("a", 1<<20)
+	deflated, _ := compress.AppendDeflateBytesLevel(nil, []byte(large), DefaultCompression)
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write([]byte(large))
+	_ = gw.Close()
+
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression,
+		WithDecompressFn(DefaultDecompressHandle),
+		WithInflateLimits(compress.InflateLimits{MaxSize: 1000}),
+		WithDecompressionLimitStatus(http.StatusRequestEntityTooLarge)))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, strconv.Itoa(len(c.Request.Body())))
+	})
+	for _, body := range [][]byte{deflated, gz.Bytes()} {
+		w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(body), Len: len(body)},
+			ut.Header{Key: "Content-Encoding", Value: "deflate"}).Result()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.StatusCode())
+	}
+
+	router = route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Deflate(DefaultCompression,
+		WithDecompressFn(StreamingDecompressHandle),
+		WithInflateLimits(compress.InflateLimits{MaxSize: 1000})))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		data, err := io.ReadAll(c.Request.BodyStream())
+		assert.Equal(t, compress.ErrInflateLimit, err)
+		c.String(200, strconv.Itoa(len(data)))
+	})
+	w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(deflated), Len: len(deflated)},
+		ut.Header{Key: "Content-Encoding", Value: "deflate"}).Result()
+	assert.Equal(t, "1000", string(w.Body()))
+
+	// the default limits bound the inflated bodies as well
+	c := app.NewContext(0)
+	c.Request.SetBody(deflated)
+	c.Request.Header.Set("Content-Encoding", "deflate")
+	DefaultDecompressHandle(context.Background(), c)
+	assert.False(t, c.IsAborted())
+	assert.Equal(t, len(large), len(c.Request.Body()))
+}
+
 func TestDeflateForClient(t *testing.T) {
 	h := server.Default(server.WithHostPorts("127.0.0.1:2333"))
 
@@ -231,7 +2483,11 @@ func TestDeflateForClient(t *testing.T) {
 	assert.Equal(t, req.Header.Get("Vary"), "Accept-Encoding")
 	assert.Equal(t, req.Header.Get("Content-Encoding"), "deflate")
 	assert.NotEqual(t, req.Header.Get("Content-Length"), "0")
-	assert.NotEqual(t, fmt.Sprint(len(req.Body())), req.Header.Get("Content-Length"))
+	// the compressed body is kept for retries
+	assert.Equal(t, fmt.Sprint(len(req.Body())), req.Header.Get("Content-Length"))
+	inflated, err := compress.AppendInflateBytes(nil, req.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", string(inflated))
 }
 
 func TestDeflatePNGForClient(t *testing.T) {
@@ -397,3 +2653,506 @@ func TestDecompressDeflateForClient(t *testing.T) {
 	assert.Equal(t, testResponse, string(res.Body()))
 	assert.Equal(t, "21", res.Header.Get("Content-Length"))
 }
+
+func TestDeflateForClientRetry(t *testing.T) {
+	var attempts int32
+	h := server.Default(server.WithHostPorts("127.0.0.1:2340"))
+	h.Use(Deflate(DefaultCompression, WithDecompressFn(DefaultDecompressHandle)))
+	h.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			c.String(http.StatusServiceUnavailable, "retry")
+			return
+		}
+		c.String(http.StatusOK, string(c.Request.Body()))
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient(client.WithRetryConfig(retry.WithMaxAttemptTimes(2)))
+	if err != nil {
+		panic(err)
+	}
+	cli.SetRetryIfFunc(func(req *protocol.Request, resp *protocol.Response, err error) bool {
+		return resp.StatusCode() == http.StatusServiceUnavailable
+	})
+	cli.Use(DeflateForClient(DefaultCompression))
+
+	req := protocol.AcquireRequest()
+	res := protocol.AcquireResponse()
+	req.SetMethod(consts.MethodPost)
+	req.SetBodyString(testResponse)
+	req.SetRequestURI("http://127.0.0.1:2340/")
+	if err = cli.Do(context.Background(), req, res); err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+	assert.Equal(t, http.StatusOK, res.StatusCode())
+	assert.Equal(t, testResponse, string(res.Body()))
+}
+
+func TestStreamTrailers(t *testing.T) {
+	body := strings.Repeat("long download ", 10000)
+	h := server.Default(server.WithHostPorts("127.0.0.1:2341"))
+	h.Use(Deflate(DefaultCompression, WithStreamTrailers()))
+	h.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.SetContentType("text/plain")
+		c.Response.SetBodyStream(strings.NewReader(body), -1)
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	req := protocol.AcquireRequest()
+	res := protocol.AcquireResponse()
+	req.SetRequestURI("http://127.0.0.1:2341/")
+	req.SetHeader("Accept-Encoding", "deflate")
+	if err = cli.Do(context.Background(), req, res); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	assert.Equal(t, "deflate", res.Header.Get("Content-Encoding"))
+	inflated, err := compress.AppendInflateBytes(nil, res.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, body, string(inflated))
+	assert.Equal(t, strconv.Itoa(len(body)), res.Header.Trailer().Get(HeaderUncompressedLength))
+	assert.Equal(t, fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(body))), res.Header.Trailer().Get(HeaderUncompressedCRC32))
+}
+
+func TestStreamingUploadsForClient(t *testing.T) {
+	body := strings.Repeat("large upload ", 10000)
+	h := server.Default(server.WithHostPorts("127.0.0.1:2342"))
+	h.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		inflated, err := compress.AppendInflateBytes(nil, c.Request.Body())
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.String(http.StatusOK, "%s %d %s %s", c.Request.Header.Get("Content-Encoding"), len(inflated),
+			c.Request.Header.Trailer().Get(HeaderUncompressedLength), c.Request.Header.Trailer().Get(HeaderUncompressedCRC32))
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	cli.Use(DeflateForClient(DefaultCompression, WithStreamingUploadsForClient()))
+
+	req := protocol.AcquireRequest()
+	res := protocol.AcquireResponse()
+	req.SetMethod(consts.MethodPost)
+	req.SetBodyStream(strings.NewReader(body), len(body))
+	req.SetRequestURI("http://127.0.0.1:2342/")
+	if err = cli.Do(context.Background(), req, res); err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode())
+	assert.Equal(t, fmt.Sprintf("deflate %d %d %08x", len(body), len(body), crc32.ChecksumIEEE([]byte(body))), string(res.Body()))
+}
+
+func TestDecompressContentTypesForClient(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2343"))
+	h.GET("/blob", func(ctx context.Context, c *app.RequestContext) {
+		b, _ := compress.AppendDeflateBytesLevel(nil, []byte("blob"), DefaultCompression)
+		c.Data(http.StatusOK, "application/zlib", b)
+	})
+	h.GET("/encoded", func(ctx context.Context, c *app.RequestContext) {
+		b, _ := compress.AppendDeflateBytesLevel(nil, []byte("blob"), DefaultCompression)
+		c.Header("Content-Encoding", "gzip")
+		c.Data(http.StatusOK, "application/x-deflate", b)
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	cli.Use(DeflateForClient(DefaultCompression,
+		WithDecompressFnForClient(DefaultDecompressMiddlewareForClient),
+		WithDecompressContentTypesForClient([]string{"Application/Zlib", "application/x-deflate"})))
+
+	status, body, err := cli.Get(context.Background(), nil, "http://127.0.0.1:2343/blob")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "blob", string(body))
+
+	req := protocol.AcquireRequest()
+	res := protocol.AcquireResponse()
+	req.SetRequestURI("http://127.0.0.1:2343/blob")
+	assert.Nil(t, cli.Do(context.Background(), req, res))
+	assert.Equal(t, "application/octet-stream", string(res.Header.ContentType()))
+
+	// another Content-Encoding isn't replaced by deflate
+	status, body, err = cli.Get(context.Background(), nil, "http://127.0.0.1:2343/encoded")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	inflated, err := compress.AppendInflateBytes(nil, body)
+	assert.Nil(t, err)
+	assert.Equal(t, "blob", string(inflated))
+}
+
+func TestMetricsHookForClient(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2344"))
+	h.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(http.StatusOK, "ok")
+	})
+	h.POST("/unsupported", func(ctx context.Context, c *app.RequestContext) {
+		c.String(http.StatusUnsupportedMediaType, "unsupported")
+	})
+	h.POST("/marker", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("X-App-Error", "bad body")
+		c.String(http.StatusOK, "ok")
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	var stats []ClientStats
+	cli, err := client.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	cli.Use(DeflateForClient(DefaultCompression,
+		WithExcludedPathsForClient([]string{"/excluded"}),
+		WithMetricsHookForClient(func(req *protocol.Request, resp *protocol.Response, s ClientStats) {
+			stats = append(stats, s)
+		}),
+		WithAcceptanceFuncForClient(func(req *protocol.Request, resp *protocol.Response) bool {
+			return DefaultAcceptanceFunc(req, resp) && len(resp.Header.Peek("X-App-Error")) == 0
+		})))
+
+	body := strings.Repeat("compressed ", 100)
+	for _, path := range []string{"/", "/unsupported", "/marker", "/excluded"} {
+		req := protocol.AcquireRequest()
+		res := protocol.AcquireResponse()
+		req.SetMethod(consts.MethodPost)
+		req.SetBodyString(body)
+		req.SetRequestURI("http://127.0.0.1:2344" + path)
+		assert.Nil(t, cli.Do(context.Background(), req, res))
+	}
+	assert.Equal(t, 3, len(stats))
+	assert.Equal(t, http.StatusOK, stats[0].StatusCode)
+	assert.True(t, stats[0].Accepted)
+	assert.Equal(t, len(body), stats[0].UncompressedSize)
+	assert.True(t, stats[0].CompressedSize > 0 && stats[0].CompressedSize < len(body))
+	assert.Equal(t, http.StatusUnsupportedMediaType, stats[1].StatusCode)
+	assert.False(t, stats[1].Accepted)
+	assert.Equal(t, http.StatusOK, stats[2].StatusCode)
+	assert.False(t, stats[2].Accepted)
+}
+
+func TestRestoreBodyForClient(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2345"))
+	h.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		inflated, err := compress.AppendInflateBytes(nil, c.Request.Body())
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.String(http.StatusOK, string(inflated))
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	body := strings.Repeat("hedged ", 100)
+	send := func(cli *client.Client, req *protocol.Request) {
+		res := protocol.AcquireResponse()
+		if err := cli.Do(context.Background(), req, res); err != nil {
+			t.Fatalf("Post: %v", err)
+		}
+		assert.Equal(t, http.StatusOK, res.StatusCode())
+		assert.Equal(t, body, string(res.Body()))
+	}
+
+	cli, err := client.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	cli.Use(DeflateForClient(DefaultCompression))
+	req := protocol.AcquireRequest()
+	req.SetMethod(consts.MethodPost)
+	req.SetRequestURI("http://127.0.0.1:2345/")
+	req.SetBodyString(body)
+	original := req.Body()
+	send(cli, req)
+	// the caller's slice isn't overwritten by the compressed body
+	assert.Equal(t, body, string(original))
+	assert.Equal(t, "deflate", req.Header.Get("Content-Encoding"))
+
+	cli, err = client.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	cli.Use(DeflateForClient(DefaultCompression, WithRestoreBodyForClient()))
+	req = protocol.AcquireRequest()
+	req.SetMethod(consts.MethodPost)
+	req.SetRequestURI("http://127.0.0.1:2345/")
+	req.SetBodyString(body)
+	send(cli, req)
+	assert.Equal(t, body, string(req.Body()))
+	assert.Equal(t, "", req.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", req.Header.Get("Vary"))
+
+	// the restored request can be sent again or cloned
+	clone := protocol.AcquireRequest()
+	req.CopyTo(clone)
+	send(cli, req)
+	send(cli, clone)
+}
+
+func TestChunkedUploadsForClient(t *testing.T) {
+	// with streamed bodies, the server keeps the Content-Length of chunked requests at -1
+	h := server.Default(server.WithHostPorts("127.0.0.1:2346"), server.WithStreamBody(true))
+	h.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		contentLength := c.Request.Header.ContentLength()
+		inflated, err := compress.AppendInflateBytes(nil, c.Request.Body())
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.String(http.StatusOK, "%t %s", contentLength < 0, inflated)
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	body := strings.Repeat("chunked ", 100)
+	for _, tc := range []struct {
+		opts     []ClientOption
+		expected string
+	}{
+		{nil, "false " + body},
+		{[]ClientOption{WithChunkedUploadsForClient()}, "true " + body},
+	} {
+		cli, err := client.NewClient()
+		if err != nil {
+			panic(err)
+		}
+		cli.Use(DeflateForClient(DefaultCompression, tc.opts...))
+		req := protocol.AcquireRequest()
+		res := protocol.AcquireResponse()
+		req.SetMethod(consts.MethodPost)
+		req.SetRequestURI("http://127.0.0.1:2346/")
+		req.SetBodyString(body)
+		if err = cli.Do(context.Background(), req, res); err != nil {
+			t.Fatalf("Post: %v", err)
+		}
+		assert.Equal(t, http.StatusOK, res.StatusCode())
+		assert.Equal(t, tc.expected, string(res.Body()))
+	}
+}
+
+func TestFinalWriter(t *testing.T) {
+	page := strings.Repeat("error page ", 50)
+	h := server.New(server.WithHostPorts("127.0.0.1:2347"))
+	// a recovery middleware registered before the deflate one
+	h.Use(func(ctx context.Context, c *app.RequestContext) {
+		defer func() {
+			if r := recover(); r != nil {
+				c.String(http.StatusInternalServerError, page)
+				c.Abort()
+			}
+		}()
+		c.Next(ctx)
+	})
+	stats := &RouteStats{}
+	h.Use(Deflate(DefaultCompression, WithFinalWriter(), WithRouteStats(stats)))
+	h.GET("/panic", func(ctx context.Context, c *app.RequestContext) {
+		panic("handler")
+	})
+	h.GET("/ok", func(ctx context.Context, c *app.RequestContext) {
+		c.String(http.StatusOK, testResponse)
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	for path, expected := range map[string]string{"/panic": page, "/ok": testResponse} {
+		req := protocol.AcquireRequest()
+		res := protocol.AcquireResponse()
+		req.SetRequestURI("http://127.0.0.1:2347" + path)
+		req.Header.Set("Accept-Encoding", "deflate")
+		if err = cli.Do(context.Background(), req, res); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		assert.Equal(t, "deflate", res.Header.Get("Content-Encoding"), path)
+		inflated, err := compress.AppendInflateBytes(nil, res.Body())
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(inflated))
+	}
+	assert.Equal(t, RouteCounts{Compressed: 1}, stats.Snapshot()["/ok"])
+}
+
+func TestFinalWriterOuterBody(t *testing.T) {
+	page := strings.Repeat("error page ", 50)
+	h := server.New(server.WithHostPorts("127.0.0.1:2350"))
+	// an error middleware registered before the deflate one
+	h.Use(func(ctx context.Context, c *app.RequestContext) {
+		c.Next(ctx)
+		switch string(c.Path()) {
+		case "/set":
+			c.Response.SetBody([]byte(page))
+		case "/reset":
+			c.AbortWithMsg(page, http.StatusUnauthorized)
+		}
+	})
+	h.Use(Deflate(DefaultCompression, WithFinalWriter()))
+	h.GET("/:path", func(ctx context.Context, c *app.RequestContext) {
+		c.String(http.StatusOK, testResponse)
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	for path, encoding := range map[string]string{"/set": "deflate", "/reset": ""} {
+		req := protocol.AcquireRequest()
+		res := protocol.AcquireResponse()
+		req.SetRequestURI("http://127.0.0.1:2350" + path)
+		req.Header.Set("Accept-Encoding", "deflate")
+		if err = cli.Do(context.Background(), req, res); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		// the body set by the outer middleware replaces the handler's
+		assert.Equal(t, encoding, res.Header.Get("Content-Encoding"), path)
+		body := res.Body()
+		if encoding != "" {
+			body, err = compress.AppendInflateBytes(nil, body)
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, page, string(body), path)
+	}
+}
+
+func TestSpooling(t *testing.T) {
+	dir := t.TempDir()
+	body := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(body)
+	var stats Stats
+	h := server.New(server.WithHostPorts("127.0.0.1:2348"))
+	h.Use(Deflate(DefaultCompression, WithSpooling(1024, dir), WithMetricsHook(func(c *app.RequestContext, s Stats) {
+		stats = s
+	})))
+	h.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(http.StatusOK, "application/octet-stream", body)
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	req := protocol.AcquireRequest()
+	res := protocol.AcquireResponse()
+	req.SetRequestURI("http://127.0.0.1:2348/")
+	req.Header.Set("Accept-Encoding", "deflate")
+	if err = cli.Do(context.Background(), req, res); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	assert.Equal(t, "deflate", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(stats.CompressedSize), res.Header.Get("Content-Length"))
+	inflated, err := compress.AppendInflateBytes(nil, res.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, body, inflated)
+	// the spool file is removed once the response is sent
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestContinueHandler(t *testing.T) {
+	buf, _ := compress.AppendDeflateBytesLevel(nil, []byte(testResponse), DefaultCompression)
+	mw := NewDeflateSrvMiddleware(DefaultCompression,
+		WithMaxCompressedRequestSize(len(buf)),
+		WithMaxConcurrentDecompressions(1),
+		WithDecompressFn(DefaultDecompressHandle))
+	h := server.New(server.WithHostPorts("127.0.0.1:2349"))
+	h.Engine.ContinueHandler = mw.ContinueHandler
+	h.Use(mw.SrvMiddleware)
+	h.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "text/plain", c.GetRawData())
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	for _, tc := range []struct {
+		size   int
+		busy   bool
+		status string
+	}{
+		{len(buf) + 1, false, "413"},
+		{len(buf), true, "417"},
+		{len(buf), false, "100"},
+	} {
+		if tc.busy {
+			mw.decompressions <- struct{}{}
+		}
+		conn, err := net.Dial("tcp", "127.0.0.1:2349")
+		assert.Nil(t, err)
+		fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: 127.0.0.1\r\nContent-Encoding: deflate\r\n"+
+			"Expect: 100-continue\r\nContent-Length: %d\r\n\r\n", tc.size)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(line, "HTTP/1.1 "+tc.status), line)
+		conn.Close()
+		if tc.busy {
+			<-mw.decompressions
+		}
+	}
+}
+
+func TestNewSuite(t *testing.T) {
+	srvMiddleware, cliMiddleware := NewSuite(DefaultCompression,
+		WithSuiteExcludedPaths([]string{"/api/"}), WithSuiteDecompression())
+
+	h := server.Default(server.WithHostPorts("127.0.0.1:2339"))
+	h.Use(srvMiddleware)
+	h.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, string(c.Request.Body()))
+	})
+	h.POST("/api/books", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, c.Request.Header.Get("Content-Encoding"))
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	cli.Use(cliMiddleware)
+
+	req := protocol.AcquireRequest()
+	res := protocol.AcquireResponse()
+	req.SetMethod(consts.MethodPost)
+	req.SetBodyString(testResponse)
+	req.SetRequestURI("http://127.0.0.1:2339/")
+	req.SetHeader("Accept-Encoding", "deflate")
+	err = cli.Do(context.Background(), req, res)
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	assert.Equal(t, "deflate", req.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(res.Body()))
+
+	req.Reset()
+	res.Reset()
+	req.SetMethod(consts.MethodPost)
+	req.SetBodyString(testResponse)
+	req.SetRequestURI("http://127.0.0.1:2339/api/books")
+	err = cli.Do(context.Background(), req, res)
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	assert.Equal(t, "", req.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", string(res.Body()))
+}
@@ -0,0 +1,109 @@
+// Package deflatetest provides helpers to test handlers served behind the
+// deflate middleware: building encoded request bodies, checking that responses
+// are validly compressed and performing requests with decoded results.
+package deflatetest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"deflate/compress"
+	"github.com/cloudwego/hertz/pkg/common/ut"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/cloudwego/hertz/pkg/route"
+)
+
+// DeflateBody returns body compressed with deflate at the default level
+func DeflateBody(t testing.TB, body []byte) []byte {
+	t.Helper()
+	deflated, err := compress.AppendDeflateBytesLevel(nil, body, compress.CompressDefaultCompression)
+	if err != nil {
+		t.Fatalf("deflatetest: deflate body: %s", err)
+	}
+	return deflated
+}
+
+// GzipBody returns body compressed with gzip at the default level
+func GzipBody(t testing.TB, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(body); err != nil {
+		t.Fatalf("deflatetest: gzip body: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("deflatetest: gzip body: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// Decode returns the body of resp decoded according to its Content-Encoding.
+// Bodies without Content-Encoding are returned as they are.
+func Decode(t testing.TB, resp *protocol.Response) []byte {
+	t.Helper()
+	body := resp.Body()
+	switch encoding := resp.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+		return body
+	case "deflate", "x-deflate":
+		inflated, err := compress.AppendInflateBytes(nil, body)
+		if err != nil {
+			t.Fatalf("deflatetest: invalid deflate body: %s", err)
+		}
+		return inflated
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("deflatetest: invalid gzip body: %s", err)
+		}
+		inflated, err := io.ReadAll(gr)
+		if err != nil {
+			t.Fatalf("deflatetest: invalid gzip body: %s", err)
+		}
+		return inflated
+	default:
+		t.Fatalf("deflatetest: unsupported Content-Encoding %q", encoding)
+		return nil
+	}
+}
+
+// AssertDeflated fails the test unless resp is deflate encoded, advertises it
+// through Vary and inflates to want
+func AssertDeflated(t testing.TB, resp *protocol.Response, want []byte) {
+	t.Helper()
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "deflate" {
+		t.Fatalf("deflatetest: unexpected Content-Encoding %q. Expecting deflate", encoding)
+	}
+	if vary := resp.Header.Get("Vary"); vary != "Accept-Encoding" {
+		t.Fatalf("deflatetest: unexpected Vary %q. Expecting Accept-Encoding", vary)
+	}
+	if got := Decode(t, resp); !bytes.Equal(got, want) {
+		t.Fatalf("deflatetest: unexpected body %q. Expecting %q", got, want)
+	}
+}
+
+// AssertNotCompressed fails the test if resp has a Content-Encoding
+func AssertNotCompressed(t testing.TB, resp *protocol.Response) {
+	t.Helper()
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		t.Fatalf("deflatetest: unexpected Content-Encoding %q", encoding)
+	}
+}
+
+// PerformRequest sends a request accepting deflate to engine, with body deflate
+// encoded when it isn't nil, and returns the response together with its
+// decoded body
+func PerformRequest(t testing.TB, engine *route.Engine, method, url string, body []byte, headers ...ut.Header) (*protocol.Response, []byte) {
+	t.Helper()
+	headers = append([]ut.Header{{Key: "Accept-Encoding", Value: "deflate"}}, headers...)
+	var reqBody *ut.Body
+	if body != nil {
+		deflated := DeflateBody(t, body)
+		reqBody = &ut.Body{Body: bytes.NewReader(deflated), Len: len(deflated)}
+		headers = append(headers, ut.Header{Key: "Content-Encoding", Value: "deflate"})
+	}
+	resp := ut.PerformRequest(engine, method, url, reqBody, headers...).Result()
+	return resp, Decode(t, resp)
+}
@@ -0,0 +1,45 @@
+package deflatetest
+
+import (
+	"context"
+	"testing"
+
+	"deflate"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/common/config"
+	"github.com/cloudwego/hertz/pkg/common/test/assert"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"github.com/cloudwego/hertz/pkg/route"
+)
+
+const testBody = "Gzip Test Response Gzip Test Response Gzip Test Response"
+
+func TestPerformRequest(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(deflate.Deflate(deflate.DefaultCompression, deflate.WithDecompressFn(deflate.DefaultDecompressHandle)))
+	router.POST("/echo", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, string(c.Request.Body()))
+	})
+
+	resp, body := PerformRequest(t, router, consts.MethodPost, "/echo", []byte(testBody))
+	AssertDeflated(t, resp, []byte(testBody))
+	assert.DeepEqual(t, testBody, string(body))
+}
+
+func TestDecode(t *testing.T) {
+	resp := &protocol.Response{}
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.SetBody(GzipBody(t, []byte(testBody)))
+	assert.DeepEqual(t, testBody, string(Decode(t, resp)))
+
+	resp = &protocol.Response{}
+	resp.Header.Set("Content-Encoding", "deflate")
+	resp.SetBody(DeflateBody(t, []byte(testBody)))
+	assert.DeepEqual(t, testBody, string(Decode(t, resp)))
+
+	resp = &protocol.Response{}
+	resp.SetBody([]byte(testBody))
+	AssertNotCompressed(t, resp)
+	assert.DeepEqual(t, testBody, string(Decode(t, resp)))
+}
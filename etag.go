@@ -0,0 +1,115 @@
+package deflate
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+// ETagPolicy controls how the ETag of a response is rewritten once its body is compressed
+type ETagPolicy int
+
+const (
+	// ETagKeep leaves the ETag untouched
+	ETagKeep ETagPolicy = iota
+	// ETagWeaken turns a strong ETag "v" into the weak W/"v"
+	ETagWeaken
+	// ETagSuffix turns a strong ETag "v" into "v-deflate"
+	ETagSuffix
+)
+
+// UnmarshalText parses the policy names keep, weaken and suffix
+func (p *ETagPolicy) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "keep":
+		*p = ETagKeep
+	case "weaken":
+		*p = ETagWeaken
+	case "suffix":
+		*p = ETagSuffix
+	default:
+		return fmt.Errorf("deflate: unknown ETag policy %q", text)
+	}
+	return nil
+}
+
+// transformETag applies policy to etag, weak ETags are never changed
+func transformETag(etag string, policy ETagPolicy) string {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	switch policy {
+	case ETagWeaken:
+		return "W/" + etag
+	case ETagSuffix:
+		if strings.HasSuffix(etag, `"`) && len(etag) >= 2 {
+			return etag[:len(etag)-1] + `-deflate"`
+		}
+		return etag + "-deflate"
+	default:
+		return etag
+	}
+}
+
+// rewriteETag applies the ETagPolicy to the ETag of the response of c, once it
+// is known to be deflate encoded
+func (d *DeflateSrvMiddleware) rewriteETag(c *app.RequestContext) {
+	if d.ETagPolicy == ETagKeep {
+		return
+	}
+	if etag := c.Response.Header.Get("ETag"); etag != "" {
+		c.Response.Header.Set("ETag", transformETag(etag, d.ETagPolicy))
+	}
+}
+
+// NormalizeETag undoes what policy did to etag, returning the strong ETag the
+// handler set: W/"v" gives "v", and so does "v-deflate" under ETagSuffix.
+// policy is the ETagPolicy of the middleware for the ETag of a compressed
+// response, ETagKeep for others: the -deflate suffix of their ETags is the
+// handler's own.
+func NormalizeETag(etag string, policy ETagPolicy) string {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	if policy != ETagSuffix {
+		return etag
+	}
+	if strings.HasSuffix(etag, `-deflate"`) {
+		return etag[:len(etag)-len(`-deflate"`)] + `"`
+	}
+	return strings.TrimSuffix(etag, "-deflate")
+}
+
+// ETagMatches reports whether the If-None-Match header value ifNoneMatch
+// matches etag, the ETag set by the handler, whichever ETagPolicy was applied
+// to the ETags the client got. Like the weak comparison If-None-Match calls
+// for, the weakness is ignored.
+func ETagMatches(ifNoneMatch, etag string) bool {
+	etag = NormalizeETag(etag, ETagKeep)
+	// the ETag the client got for the compressed representation under ETagSuffix
+	suffixed := transformETag(etag, ETagSuffix)
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if candidate = NormalizeETag(candidate, ETagKeep); candidate != "" && (candidate == etag || candidate == suffixed) {
+			return true
+		}
+	}
+	return false
+}
+
+// NotModified answers the conditional request of c with 304 Not Modified when
+// its If-None-Match matches etag, the ETag of the uncompressed representation,
+// and reports whether it did. The middleware gives the 304 the ETag of the
+// representation the client holds, per the ETagPolicy.
+func NotModified(c *app.RequestContext, etag string) bool {
+	ifNoneMatch := c.Request.Header.Get("If-None-Match")
+	if ifNoneMatch == "" || !ETagMatches(ifNoneMatch, etag) {
+		return false
+	}
+	c.Header("ETag", etag)
+	c.Status(http.StatusNotModified)
+	return true
+}
@@ -0,0 +1,36 @@
+package deflate
+
+import (
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/http1/resp"
+)
+
+// finalWriter is the hijack writer installed by WithFinalWriter: the body is
+// buffered as usual and the response is compressed when the server finalizes
+// it, after every middleware returned
+type finalWriter struct {
+	d *DeflateSrvMiddleware
+	c *app.RequestContext
+}
+
+func (f *finalWriter) Write(p []byte) (int, error) {
+	return f.c.Response.BodyBuffer().Write(p)
+}
+
+// SetBody replaces the buffered body, e.g. for a middleware rewriting the
+// response after the next handlers returned
+func (f *finalWriter) SetBody(b []byte) {
+	f.c.Response.BodyBuffer().Set(b)
+}
+
+// Flush does nothing, the response is only written by Finalize
+func (f *finalWriter) Flush() error {
+	return nil
+}
+
+func (f *finalWriter) Finalize() error {
+	f.c.Response.HijackWriter(nil)
+	f.d.compressResponse(f.c)
+	f.d.finish(f.c)
+	return resp.Write(&f.c.Response, f.c.GetWriter())
+}
@@ -0,0 +1,41 @@
+package deflate
+
+import (
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+// Group builds server middlewares for several route groups from shared
+// options. Its middlewares use the same writer pools and record their
+// responses in the same RouteStats.
+type Group struct {
+	level int
+	opts  []Option
+	stats *RouteStats
+}
+
+// NewGroup returns a Group whose middlewares compress with level and opts
+func NewGroup(level int, opts ...Option) *Group {
+	g := &Group{level: level, stats: &RouteStats{}}
+	// opts may replace the RouteStats of the group
+	g.opts = append([]Option{WithRouteStats(g.stats)}, opts...)
+	return g
+}
+
+// Handler returns a middleware using the options of the group
+func (g *Group) Handler() app.HandlerFunc {
+	return g.HandlerWith()
+}
+
+// HandlerWith returns a middleware using the options of the group followed by
+// opts, e.g. to tune the level or the exclusions of a route group
+func (g *Group) HandlerWith(opts ...Option) app.HandlerFunc {
+	all := make([]Option, 0, len(g.opts)+len(opts))
+	all = append(all, g.opts...)
+	return Deflate(g.level, append(all, opts...)...)
+}
+
+// Stats returns the RouteStats shared by the middlewares of the group, unless
+// replaced with WithRouteStats
+func (g *Group) Stats() *RouteStats {
+	return g.stats
+}
@@ -0,0 +1,67 @@
+package deflate
+
+import (
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol"
+)
+
+// CompressionClaimKey is the RequestContext key marking that a compression
+// middleware already handles the response. Other compression middlewares can
+// share it through ClaimCompression to avoid encoding a response twice.
+const CompressionClaimKey = "compression.claimed"
+
+// OriginalBodyKey is the RequestContext key of the uncompressed body of a
+// compressed response, see WithKeepOriginalBody
+const OriginalBodyKey = "deflate.original_body"
+
+// OriginalBody returns the uncompressed body of the response of c kept by
+// WithKeepOriginalBody, ok is false when the response wasn't compressed
+func OriginalBody(c *app.RequestContext) (body []byte, ok bool) {
+	v, ok := c.Get(OriginalBodyKey)
+	if !ok {
+		return nil, false
+	}
+	return v.([]byte), true
+}
+
+// SkipKey is the RequestContext key under which the handler may store true to
+// leave its response uncompressed, like setting Content-Encoding: identity
+const SkipKey = "deflate.skip"
+
+// optedOut reports whether the handler opted the response of c out of
+// compression with SkipKey or Content-Encoding: identity, the latter being
+// removed from the response
+func optedOut(c *app.RequestContext) bool {
+	identity := strings.EqualFold(strings.TrimSpace(c.Response.Header.Get("Content-Encoding")), "identity")
+	if identity {
+		c.Response.Header.Del("Content-Encoding")
+	}
+	return identity || c.GetBool(SkipKey)
+}
+
+// ClaimCompression marks the response of c as handled by the calling
+// middleware. It returns false when another middleware claimed it first.
+func ClaimCompression(c *app.RequestContext) bool {
+	if _, ok := c.Get(CompressionClaimKey); ok {
+		return false
+	}
+	c.Set(CompressionClaimKey, true)
+	return true
+}
+
+// IsResponseEncoded reports whether resp already has a Content-Encoding other than identity
+func IsResponseEncoded(resp *protocol.Response) bool {
+	return isEncoded(resp.Header.Get("Content-Encoding"))
+}
+
+// IsRequestEncoded reports whether req already has a Content-Encoding other than identity
+func IsRequestEncoded(req *protocol.Request) bool {
+	return isEncoded(req.Header.Get("Content-Encoding"))
+}
+
+func isEncoded(encoding string) bool {
+	encoding = strings.TrimSpace(encoding)
+	return encoding != "" && !strings.EqualFold(encoding, "identity")
+}
@@ -0,0 +1,21 @@
+package deflate
+
+import (
+	"context"
+	"net/http"
+
+	"deflate/compress"
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+// HealthCheckHandler runs compress.SelfTest and answers 200 "ok", or 503 with
+// the error, so readiness probes can cover the compression subsystem:
+//
+//	h.GET("/healthz/deflate", deflate.HealthCheckHandler)
+func HealthCheckHandler(ctx context.Context, c *app.RequestContext) {
+	if err := compress.SelfTest(); err != nil {
+		c.String(http.StatusServiceUnavailable, "deflate: "+err.Error())
+		return
+	}
+	c.String(http.StatusOK, "ok")
+}
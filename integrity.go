@@ -0,0 +1,101 @@
+package deflate
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/protocol"
+)
+
+// IntegrityPolicy controls the integrity headers (Content-MD5, Digest,
+// Content-Digest and Repr-Digest) of responses whose body gets compressed
+type IntegrityPolicy int
+
+const (
+	// IntegrityDrop removes the integrity headers
+	IntegrityDrop IntegrityPolicy = iota
+	// IntegrityRecompute recomputes them over the compressed body, dropping
+	// digests of unsupported algorithms
+	IntegrityRecompute
+	// IntegrityKeep leaves them untouched
+	IntegrityKeep
+)
+
+// UnmarshalText parses the policy names drop, recompute and keep
+func (p *IntegrityPolicy) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "drop":
+		*p = IntegrityDrop
+	case "recompute":
+		*p = IntegrityRecompute
+	case "keep":
+		*p = IntegrityKeep
+	default:
+		return fmt.Errorf("deflate: unknown integrity policy %q", text)
+	}
+	return nil
+}
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha":     sha1.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+func digest(algorithm string, body []byte) (string, bool) {
+	newHash, ok := digestAlgorithms[strings.ToLower(algorithm)]
+	if !ok {
+		return "", false
+	}
+	h := newHash()
+	h.Write(body)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), true
+}
+
+// rewriteIntegrityHeaders applies policy to the integrity headers of h once
+// the body has been replaced by body
+func rewriteIntegrityHeaders(h *protocol.ResponseHeader, body []byte, policy IntegrityPolicy) {
+	switch policy {
+	case IntegrityKeep:
+		return
+	case IntegrityRecompute:
+		if h.Get("Content-MD5") != "" {
+			sum, _ := digest("md5", body)
+			h.Set("Content-MD5", sum)
+		}
+		// Digest uses alg=base64 (RFC 3230), the others alg=:base64: (RFC 9530)
+		recomputeDigestHeader(h, "Digest", body, "")
+		recomputeDigestHeader(h, "Content-Digest", body, ":")
+		recomputeDigestHeader(h, "Repr-Digest", body, ":")
+	default:
+		for _, key := range []string{"Content-MD5", "Digest", "Content-Digest", "Repr-Digest"} {
+			h.Del(key)
+		}
+	}
+}
+
+func recomputeDigestHeader(h *protocol.ResponseHeader, key string, body []byte, delim string) {
+	value := h.Get(key)
+	if value == "" {
+		return
+	}
+	var digests []string
+	for _, member := range strings.Split(value, ",") {
+		algorithm, _, _ := strings.Cut(strings.TrimSpace(member), "=")
+		if sum, ok := digest(algorithm, body); ok {
+			digests = append(digests, algorithm+"="+delim+sum+delim)
+		}
+	}
+	if len(digests) == 0 {
+		h.Del(key)
+		return
+	}
+	h.Set(key, strings.Join(digests, ", "))
+}
@@ -0,0 +1,92 @@
+package deflate
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configDocument is the JSON or YAML document read by FromConfig
+type configDocument struct {
+	// the configs are inlined without their UnmarshalYAML, which would take
+	// over the whole sections
+	Server struct {
+		Config plainConfig `yaml:",inline"`
+		// Decompress selects the DecompressFn: "default", "streaming" or none
+		Decompress   string `yaml:"decompress"`
+		MemoryBudget int64  `yaml:"memory_budget"`
+	} `yaml:"server"`
+	Client struct {
+		ClientConfig plainClientConfig `yaml:",inline"`
+		Decompress   bool              `yaml:"decompress"`
+		MemoryBudget int64             `yaml:"memory_budget"`
+	} `yaml:"client"`
+}
+
+// FromConfig reads the server and client configurations from the JSON or YAML
+// document source, a file path or env:NAME for the content of the environment
+// variable NAME:
+//
+//	server:
+//	  level: 6
+//	  excluded_paths: ["/metrics"]
+//	  etag_policy: weaken
+//	  decompress: streaming
+//	client:
+//	  level: 1
+//
+// Levels default to DefaultCompression and omitted lists to the defaults of
+// the options. Both configurations are validated.
+func FromConfig(source string) (Config, ClientConfig, error) {
+	var data []byte
+	if name, ok := strings.CutPrefix(source, "env:"); ok {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return Config{}, ClientConfig{}, fmt.Errorf("deflate: environment variable %s is not set", name)
+		}
+		data = []byte(value)
+	} else {
+		var err error
+		if data, err = os.ReadFile(source); err != nil {
+			return Config{}, ClientConfig{}, fmt.Errorf("deflate: read config: %w", err)
+		}
+	}
+
+	var doc configDocument
+	doc.Server.Config.Level = DefaultCompression
+	doc.Client.ClientConfig.Level = DefaultCompression
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return Config{}, ClientConfig{}, fmt.Errorf("deflate: parse config: %w", err)
+	}
+
+	cfg := Config(doc.Server.Config)
+	switch doc.Server.Decompress {
+	case "":
+	case "default":
+		cfg.DecompressFn = DefaultDecompressHandle
+	case "streaming":
+		cfg.DecompressFn = StreamingDecompressHandle
+	default:
+		return Config{}, ClientConfig{}, fmt.Errorf("deflate: unknown decompress mode %q", doc.Server.Decompress)
+	}
+	if doc.Server.MemoryBudget > 0 {
+		cfg.MemoryBudget = NewMemoryBudget(doc.Server.MemoryBudget)
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, ClientConfig{}, err
+	}
+
+	clientCfg := ClientConfig(doc.Client.ClientConfig)
+	if doc.Client.Decompress {
+		clientCfg.DecompressFnForClient = DefaultDecompressMiddlewareForClient
+	}
+	if doc.Client.MemoryBudget > 0 {
+		clientCfg.MemoryBudget = NewMemoryBudget(doc.Client.MemoryBudget)
+	}
+	if err := clientCfg.Validate(); err != nil {
+		return Config{}, ClientConfig{}, err
+	}
+	return cfg, clientCfg, nil
+}
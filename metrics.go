@@ -0,0 +1,147 @@
+package deflate
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol"
+)
+
+// Operation is the work described by Stats
+type Operation int
+
+const (
+	// OperationCompress is the compression of a response body
+	OperationCompress Operation = iota
+	// OperationDecompress is the decompression of a request body by the DecompressFn
+	OperationDecompress
+)
+
+// Stats describes one compression or decompression done by the server middleware
+type Stats struct {
+	Operation Operation
+	// CompressedSize is the size of the deflate body, -1 when it isn't known
+	// beforehand, e.g. for request bodies streamed without Content-Length
+	CompressedSize int
+	// UncompressedSize is the size of the inflated body, -1 when it is
+	// inflated while the handler reads it
+	UncompressedSize int
+	Duration         time.Duration
+	// Err is set when the operation failed, in which case the sizes may be partial
+	Err error
+	// DryRun is set when the compressed body was only measured, see WithDryRun
+	DryRun bool
+}
+
+// Ratio returns UncompressedSize / CompressedSize, or 0 when a size is unknown
+func (s Stats) Ratio() float64 {
+	if s.CompressedSize <= 0 || s.UncompressedSize < 0 {
+		return 0
+	}
+	return float64(s.UncompressedSize) / float64(s.CompressedSize)
+}
+
+// report passes the stats of an operation started at start to the MetricsHook
+func (d *DeflateSrvMiddleware) report(c *app.RequestContext, start time.Time, stats Stats) {
+	if d.MetricsHook == nil {
+		return
+	}
+	stats.Duration = time.Since(start)
+	d.MetricsHook(c, stats)
+}
+
+// ClientStats describes a request whose body was compressed by the client
+// middleware and the response of the server
+type ClientStats struct {
+	// CompressedSize and UncompressedSize are the sizes of the request body,
+	// -1 when it was streamed, see WithStreamingUploadsForClient
+	CompressedSize   int
+	UncompressedSize int
+	// StatusCode is the response status, 0 when the request failed
+	StatusCode int
+	// Accepted reports whether the server understood the compressed body,
+	// see WithAcceptanceFuncForClient
+	Accepted bool
+	// Err is the error of the request, if any
+	Err error
+}
+
+// DefaultAcceptanceFunc reports the compressed body as rejected when the
+// response status is 415 Unsupported Media Type, which servers answer to
+// unsupported content codings (RFC 7694)
+func DefaultAcceptanceFunc(req *protocol.Request, resp *protocol.Response) bool {
+	return resp.StatusCode() != http.StatusUnsupportedMediaType
+}
+
+// reportClient passes the stats of a compressed request to the MetricsHook
+func (d *DeflateClientMiddleware) reportClient(req *protocol.Request, resp *protocol.Response, stats ClientStats) {
+	if d.MetricsHook == nil {
+		return
+	}
+	if stats.Err == nil {
+		stats.StatusCode = resp.StatusCode()
+		accepted := d.AcceptanceFunc
+		if accepted == nil {
+			accepted = DefaultAcceptanceFunc
+		}
+		stats.Accepted = accepted(req, resp)
+	}
+	d.MetricsHook(req, resp, stats)
+}
+
+// compressedKey is the RequestContext key marking a response compressed by the middleware
+const compressedKey = "deflate.compressed"
+
+// RouteCounts counts the responses of a route
+type RouteCounts struct {
+	Compressed int64
+	// Skipped counts the responses left uncompressed, whatever the reason
+	Skipped int64
+}
+
+// SkipRatio returns the share of skipped responses, or 0 when there is none
+func (r RouteCounts) SkipRatio() float64 {
+	if total := r.Compressed + r.Skipped; total > 0 {
+		return float64(r.Skipped) / float64(total)
+	}
+	return 0
+}
+
+// RouteStats counts the compressed and skipped responses per route, keyed by
+// the path of the matched route (c.FullPath(), empty when no route matched).
+// The zero value is ready to use.
+type RouteStats struct {
+	routes sync.Map // route path -> *routeCounters
+}
+
+type routeCounters struct {
+	compressed, skipped atomic.Int64
+}
+
+// Snapshot returns the counts of every route seen so far
+func (s *RouteStats) Snapshot() map[string]RouteCounts {
+	m := make(map[string]RouteCounts)
+	s.routes.Range(func(key, value interface{}) bool {
+		counters := value.(*routeCounters)
+		m[key.(string)] = RouteCounts{Compressed: counters.compressed.Load(), Skipped: counters.skipped.Load()}
+		return true
+	})
+	return m
+}
+
+func (s *RouteStats) record(c *app.RequestContext) {
+	route := c.FullPath()
+	value, ok := s.routes.Load(route)
+	if !ok {
+		value, _ = s.routes.LoadOrStore(route, &routeCounters{})
+	}
+	counters := value.(*routeCounters)
+	if _, compressed := c.Get(compressedKey); compressed {
+		counters.compressed.Add(1)
+	} else {
+		counters.skipped.Add(1)
+	}
+}
@@ -0,0 +1,297 @@
+package deflate
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+)
+
+// Default limits on the Accept-Encoding and Content-Encoding headers, longer
+// headers or headers with more codings are treated as carrying no coding
+const (
+	DefaultMaxEncodingHeaderLength = 1024
+	DefaultMaxEncodingTokens       = 32
+)
+
+// withinHeaderLimits cheaply checks header against the limits before it gets parsed,
+// a non-positive limit disables the check
+func withinHeaderLimits(header string, maxLength, maxTokens int) bool {
+	if maxLength > 0 && len(header) > maxLength {
+		return false
+	}
+	return maxTokens <= 0 || strings.Count(header, ",") < maxTokens
+}
+
+// encodingToken is one coding of an Accept-Encoding or Content-Encoding header
+type encodingToken struct {
+	// name is the lower-cased coding
+	name string
+	q    float64
+}
+
+// parseEncodingTokens splits a comma separated coding list, trimming
+// whitespace and reading the q parameter of each coding. The result is cached
+// and must not be modified.
+func parseEncodingTokens(header string) []encodingToken {
+	if header == "" {
+		return nil
+	}
+	if tokens, ok := encodingTokensCache.get(header); ok {
+		return tokens
+	}
+	tokens := splitEncodingTokens(header)
+	// oversized headers are refused by withinHeaderLimits anyway
+	if len(header) <= DefaultMaxEncodingHeaderLength {
+		encodingTokensCache.add(header, tokens)
+	}
+	return tokens
+}
+
+func splitEncodingTokens(header string) []encodingToken {
+	var tokens []encodingToken
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(param, "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(key), "q") {
+				continue
+			}
+			if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = v
+			}
+		}
+		tokens = append(tokens, encodingToken{name: name, q: q})
+	}
+	return tokens
+}
+
+// legacyEncodings maps the legacy x- coding names to the standard ones
+var legacyEncodings = map[string]string{
+	"x-deflate": "deflate",
+	"x-gzip":    "gzip",
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header accepts encoding,
+// either by name or through the * wildcard, honoring q=0 as a refusal
+func acceptsEncoding(header, encoding string) bool {
+	return acceptedToken(header, encoding, false) != ""
+}
+
+// acceptedToken returns the coding name to answer header with for encoding, or
+// "" when encoding isn't accepted. With legacy set, a legacy alias such as
+// x-deflate is returned when only the alias is accepted.
+func acceptedToken(header, encoding string, legacy bool) string {
+	wildcard, alias := 0.0, ""
+	for _, token := range parseEncodingTokens(header) {
+		switch {
+		case token.name == encoding:
+			if token.q > 0 {
+				return encoding
+			}
+			return ""
+		case token.name == "*":
+			wildcard = token.q
+		case legacy && token.q > 0 && legacyEncodings[token.name] == encoding:
+			alias = token.name
+		}
+	}
+	if alias != "" {
+		return alias
+	}
+	if wildcard > 0 {
+		return encoding
+	}
+	return ""
+}
+
+// negotiateEncoding returns the coding of supported with the highest q in the
+// Accept-Encoding header, preferring earlier entries of supported on ties.
+// identity is acceptable unless refused, but ranks below any listed coding.
+// With legacy set, legacy aliases count for their standard coding.
+func negotiateEncoding(header string, supported []string, legacy bool) (string, bool) {
+	tokens := parseEncodingTokens(header)
+	best, bestQ := "", 0.0
+	for _, encoding := range supported {
+		if q := encodingQuality(tokens, encoding, legacy); q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best, best != ""
+}
+
+// NegotiateEncoding returns the coding of supported to answer the
+// Accept-Encoding header acceptEncoding with, deciding as the middleware does,
+// for handlers which encode their responses themselves. The highest q wins,
+// earlier entries of supported win ties, and identity is acceptable unless
+// refused but ranks below any listed coding. It returns false when none of
+// supported is acceptable, e.g. to answer 406.
+func NegotiateEncoding(acceptEncoding string, supported []string) (string, bool) {
+	if !withinHeaderLimits(acceptEncoding, DefaultMaxEncodingHeaderLength, DefaultMaxEncodingTokens) {
+		acceptEncoding = ""
+	}
+	codings := make([]string, len(supported))
+	for i, encoding := range supported {
+		codings[i] = strings.ToLower(encoding)
+	}
+	return negotiateEncoding(acceptEncoding, codings, false)
+}
+
+func encodingQuality(tokens []encodingToken, encoding string, legacy bool) float64 {
+	wildcard := -1.0
+	for _, token := range tokens {
+		name := token.name
+		if std, ok := legacyEncodings[name]; ok && legacy {
+			name = std
+		}
+		switch name {
+		case encoding:
+			return token.q
+		case "*":
+			wildcard = token.q
+		}
+	}
+	if wildcard >= 0 {
+		return wildcard
+	}
+	if encoding == "identity" {
+		return 0.001
+	}
+	return 0
+}
+
+// isContentEncoding reports whether the Content-Encoding header consists of encoding only,
+// also accepting its legacy alias when legacy is set
+func isContentEncoding(header, encoding string, legacy bool) bool {
+	tokens := parseEncodingTokens(header)
+	if len(tokens) != 1 {
+		return false
+	}
+	return tokens[0].name == encoding || legacy && legacyEncodings[tokens[0].name] == encoding
+}
+
+// acceptEncoding returns all Accept-Encoding header lines of h joined into one list
+func acceptEncoding(h *protocol.RequestHeader) string {
+	return requestHeader(h, "Accept-Encoding")
+}
+
+// acceptEncodingKey is the RequestContext key of the Accept-Encoding header
+// removed from the request by WithConsumeAcceptEncoding
+const acceptEncodingKey = "deflate.accept_encoding"
+
+// requestAcceptEncoding returns the Accept-Encoding of the request of c, as
+// sent by the client even if it was consumed
+func requestAcceptEncoding(c *app.RequestContext) string {
+	if v, ok := c.Get(acceptEncodingKey); ok {
+		return v.(string)
+	}
+	return acceptEncoding(&c.Request.Header)
+}
+
+// consumeAcceptEncoding removes the Accept-Encoding header from the request
+// of c, so that the handler doesn't forward it upstream
+func consumeAcceptEncoding(c *app.RequestContext) {
+	c.Set(acceptEncodingKey, acceptEncoding(&c.Request.Header))
+	c.Request.Header.Del("Accept-Encoding")
+}
+
+// requestHeader returns all key header lines of h joined into one list
+func requestHeader(h *protocol.RequestHeader, key string) string {
+	return strings.Join(h.GetAll(key), ",")
+}
+
+// hasHeaderToken reports whether the comma separated header contains token,
+// ignoring case and parameters
+func hasHeaderToken(header, token string) bool {
+	for _, part := range strings.Split(header, ",") {
+		if i := strings.IndexAny(part, ";="); i >= 0 {
+			part = part[:i]
+		}
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// namesEncoding reports whether header accepts encoding by name, or by its
+// legacy alias when legacy is set, rather than through the * wildcard
+func namesEncoding(header, encoding string, legacy bool) bool {
+	for _, token := range parseEncodingTokens(header) {
+		if token.q <= 0 {
+			continue
+		}
+		if token.name == encoding || legacy && legacyEncodings[token.name] == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsMediaType reports whether the Accept header lists mediaType with a
+// non-zero quality, wildcards aside
+func acceptsMediaType(header, mediaType string) bool {
+	// Accept headers aren't cached, not to evict the encoding ones
+	for _, token := range splitEncodingTokens(header) {
+		if token.name == mediaType && token.q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isMediaType reports whether the Content-Type contentType is mediaType
+func isMediaType(contentType []byte, mediaType string) bool {
+	name, _, _ := strings.Cut(string(contentType), ";")
+	return strings.EqualFold(strings.TrimSpace(name), mediaType)
+}
+
+// isStreamingRequest reports whether req upgrades the connection or asks for
+// server-sent events, neither of which may be compressed
+func isStreamingRequest(req *protocol.Request) bool {
+	if acceptsMediaType(requestHeader(&req.Header, "Accept"), "text/event-stream") {
+		return true
+	}
+	if isHTTP2(req) {
+		// HTTP/2 has no Connection header, WebSockets are bootstrapped with an
+		// extended CONNECT instead (RFC 8441)
+		return req.Header.IsConnect()
+	}
+	return hasHeaderToken(requestHeader(&req.Header, "Connection"), "upgrade")
+}
+
+// isHTTP2 reports whether req was received over HTTP/2, where requests are
+// multiplexed as streams of a connection and hop-by-hop headers don't exist.
+// Each stream has its own compressor, so compressed responses are sent as
+// their body is produced like over HTTP/1.1, without chunked encoding.
+func isHTTP2(req *protocol.Request) bool {
+	return req.Header.GetProtocol() == consts.HTTP20
+}
+
+// Variant describes the representation of a response for the caches storing
+// one variant per Accept-Encoding, as announced by Vary: Accept-Encoding
+type Variant struct {
+	// Key is the Accept-Encoding of the request normalized by VariantKey
+	Key string
+	// Encoding is the Content-Encoding of the response, identity when it
+	// isn't encoded
+	Encoding string
+}
+
+// VariantKey normalizes the Accept-Encoding header to the coding the middleware
+// would answer it with: deflate, x-deflate with WithLegacyEncodings, or
+// identity. Requests with the same key get the same variant of a response, so
+// caches can use it in place of the raw header to look up a stored variant.
+func (o *Options) VariantKey(header string) string {
+	if !o.negotiate(header) {
+		return "identity"
+	}
+	return acceptedToken(header, "deflate", o.LegacyEncodings)
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"deflate/compress"
+	"io"
 	"net/http"
+	"path"
 	"regexp"
 	"strings"
 
@@ -17,8 +19,19 @@ var (
 	DefaultExcludedExtensions = NewExcludedExtensions([]string{
 		".png", ".gif", ".jpeg", ".jpg",
 	})
+	// DefaultExcludedMethods are the methods whose responses are never
+	// compressed: preflight and tunnel responses carry no content to encode
+	DefaultExcludedMethods = map[string]bool{
+		http.MethodOptions: true,
+		http.MethodConnect: true,
+	}
 	DefaultOptions = &Options{
-		ExcludedExtensions: DefaultExcludedExtensions,
+		ExcludedExtensions:       DefaultExcludedExtensions,
+		ExcludedMethods:          DefaultExcludedMethods,
+		DecompressionLimitStatus: http.StatusServiceUnavailable,
+		MaxEncodingHeaderLength:  DefaultMaxEncodingHeaderLength,
+		MaxEncodingTokens:        DefaultMaxEncodingTokens,
+		InflateLimits:            compress.DefaultInflateLimits,
 	}
 	DefaultClientExcludedExtensions = NewExcludedExtensions([]string{
 		".png", ".gif", ".jpeg", ".jpg",
@@ -30,16 +43,95 @@ var (
 
 type (
 	Options struct {
+		Level               int
 		ExcludedExtensions  ExcludedExtensions
 		ExcludedPaths       ExcludedPaths
 		ExcludedPathRegexes ExcludedPathRegexes
 		DecompressFn        app.HandlerFunc
+		AdaptiveLevel       bool
+		LoadShedder         func() bool
+		EntropyThreshold    float64
+		SniffContentType    bool
+		MemoryBudget        *MemoryBudget
+		DisableVary         bool
+		ETagPolicy          ETagPolicy
+		IntegrityPolicy     IntegrityPolicy
+		LegacyEncodings     bool
+		EncodingPriority    []string
+		SecretAwareSkip     func(c *app.RequestContext) bool
+		RandomPadding       int
+		PaddingBlock        int
+
+		MaxConcurrentDecompressions int
+		DecompressionLimitStatus    int
+		MaxEncodingHeaderLength     int
+		MaxEncodingTokens           int
+		ProxyMode                   bool
+		CDNMode                     bool
+		CDNSkipHeaders              []string
+		ErrorHook                   func(c *app.RequestContext, err error)
+		CompressHTTP10              bool
+		ExcludedRouteNames          map[string]bool
+		OriginalLengthHeader        bool
+		ChunkedResponses            bool
+		MetricsHook                 func(c *app.RequestContext, stats Stats)
+		ContentTypeLevels           map[string]int
+		CompressFn                  func(dst, src []byte, level int) ([]byte, error)
+		DryRun                      bool
+		MinSize                     int
+		MaxSize                     int
+		ParallelThreshold           int
+		RouteStats                  *RouteStats
+		PolicyFn                    func(c *app.RequestContext) Policy
+		KeepOriginalBody            bool
+		CompressedBodyHook          func(c *app.RequestContext, body []byte)
+		ConsumeAcceptEncoding       bool
+		StreamTrailers              bool
+		LenientDecompression        bool
+		FinalWriter                 bool
+		Pools                       *compress.Pools
+		// IncludedContentTypes holds the lower-cased media types of the
+		// responses which may be compressed, all of them when empty
+		IncludedContentTypes map[string]bool
+		VariantHook          func(c *app.RequestContext, v Variant)
+		SpoolThreshold       int
+		SpoolDir             string
+		// ExcludedMethods holds the upper-cased methods of the requests whose
+		// responses are left alone, Vary included
+		ExcludedMethods  map[string]bool
+		ExplicitIdentity bool
+		StreamBufferSize int
+		// MaxCompressedRequestSize bounds the size of the deflate encoded
+		// request bodies, checked before they are inflated
+		MaxCompressedRequestSize int
+		// InflateLimits bounds the inflated request bodies, see WithInflateLimits
+		InflateLimits compress.InflateLimits
+
+		excludedPathTrie *pathTrie
 	}
 	ClientOptions struct {
 		ExcludedExtensions    ExcludedExtensions
 		ExcludedPaths         ExcludedPaths
 		ExcludedPathRegexes   ExcludedPathRegexes
 		DecompressFnForClient client.Middleware
+		AdaptiveLevel         bool
+		MemoryBudget          *MemoryBudget
+		DisableVary           bool
+		LegacyEncodings       bool
+		StreamingUploads      bool
+		// DecompressContentTypes holds the lower-cased media types of the
+		// responses inflated without a deflate Content-Encoding
+		DecompressContentTypes map[string]bool
+		MetricsHook            func(req *protocol.Request, resp *protocol.Response, stats ClientStats)
+		AcceptanceFunc         func(req *protocol.Request, resp *protocol.Response) bool
+		// IncludedMethods holds the upper-cased methods of the requests whose
+		// body may be compressed, all of them when empty
+		IncludedMethods map[string]bool
+		RestoreBody     bool
+		ChunkedUploads  bool
+		Pools           *compress.Pools
+
+		excludedPathTrie *pathTrie
 	}
 	Option       func(*Options)
 	ClientOption func(*ClientOptions)
@@ -49,7 +141,14 @@ type (
 	ExcludedPathRegexes []*regexp.Regexp
 )
 
-// WithExcludedExtensions customize excluded extensions
+// WithLevel customize the compression level, overriding the one given to Deflate
+func WithLevel(level int) Option {
+	return func(o *Options) {
+		o.Level = level
+	}
+}
+
+// WithExcludedExtensions customize excluded extensions, e.g. .png, or file name patterns such as *.min.js
 func WithExcludedExtensions(args []string) Option {
 	return func(o *Options) {
 		o.ExcludedExtensions = NewExcludedExtensions(args)
@@ -83,13 +182,467 @@ func WithDecompressFn(decompressFn app.HandlerFunc) Option {
 	}
 }
 
+// WithAdaptiveLevel picks the compression level by response body size,
+// see adaptiveLevel for the thresholds
+func WithAdaptiveLevel() Option {
+	return func(o *Options) {
+		o.AdaptiveLevel = true
+	}
+}
+
+// WithLoadShedder skips compression while fn reports the process is under pressure
+func WithLoadShedder(fn func() bool) Option {
+	return func(o *Options) {
+		o.LoadShedder = fn
+	}
+}
+
+// WithEntropyThreshold skips compression when the sampled response body has
+// more than bits of entropy per byte, which indicates already compressed or
+// encrypted data. DefaultEntropyThreshold is a reasonable value.
+func WithEntropyThreshold(bits float64) Option {
+	return func(o *Options) {
+		o.EntropyThreshold = bits
+	}
+}
+
+// WithContentTypeSniffing sniffs the response body when the handler didn't set
+// a Content-Type, and skips compression for binary types such as images and archives
+func WithContentTypeSniffing() Option {
+	return func(o *Options) {
+		o.SniffContentType = true
+	}
+}
+
+// WithMemoryBudget bounds the original and compressed bytes buffered across
+// concurrent responses, from their compression until they are sent. Bodies
+// beyond the budget are sent uncompressed. Streamed and hijacked responses,
+// compressed as they are written, aren't counted.
+func WithMemoryBudget(budget *MemoryBudget) Option {
+	return func(o *Options) {
+		o.MemoryBudget = budget
+	}
+}
+
+// WithoutVaryHeader stops emitting Vary: Accept-Encoding on compressed responses,
+// for CDNs that normalize Accept-Encoding upstream
+func WithoutVaryHeader() Option {
+	return func(o *Options) {
+		o.DisableVary = true
+	}
+}
+
+// WithETagPolicy rewrites the ETag of compressed responses, since the compressed
+// representation must not share the strong ETag of the identity one
+func WithETagPolicy(policy ETagPolicy) Option {
+	return func(o *Options) {
+		o.ETagPolicy = policy
+	}
+}
+
+// WithIntegrityPolicy controls Content-MD5/Digest/Content-Digest/Repr-Digest headers
+// of compressed responses, which are dropped by default
+func WithIntegrityPolicy(policy IntegrityPolicy) Option {
+	return func(o *Options) {
+		o.IntegrityPolicy = policy
+	}
+}
+
+// WithLegacyEncodings recognizes the legacy x-deflate token in Accept-Encoding and
+// Content-Encoding, answering with x-deflate to clients accepting only that token
+func WithLegacyEncodings() Option {
+	return func(o *Options) {
+		o.LegacyEncodings = true
+	}
+}
+
+// WithEncodingPriority sets the server's preference order between codings the client
+// accepts equally, e.g. []string{"identity", "deflate"} only compresses when the
+// client prefers deflate. Codings this middleware can't produce are ignored.
+func WithEncodingPriority(encodings []string) Option {
+	return func(o *Options) {
+		o.EncodingPriority = encodings
+	}
+}
+
+// WithSecretAwareSkip skips compression when fn reports that the response mixes
+// secrets with attacker-controlled input, the precondition of the BREACH attack.
+// fn runs after the handler, so it may inspect what the handler stored.
+func WithSecretAwareSkip(fn func(c *app.RequestContext) bool) Option {
+	return func(o *Options) {
+		o.SecretAwareSkip = fn
+	}
+}
+
+// WithRandomPadding pads every compressed response with a random number of bytes
+// of empty deflate blocks, up to max rounded by compress.PaddingSize, which makes
+// BREACH-style length probing harder
+func WithRandomPadding(max int) Option {
+	return func(o *Options) {
+		o.RandomPadding = max
+	}
+}
+
+// WithPadding pads compressed responses with empty deflate blocks to a multiple
+// of minBlock bytes, reducing what response sizes leak about their content
+func WithPadding(minBlock int) Option {
+	return func(o *Options) {
+		o.PaddingBlock = minBlock
+	}
+}
+
+// WithMaxConcurrentDecompressions bounds the request decompressions running at
+// once, requests beyond the limit are answered with DecompressionLimitStatus
+func WithMaxConcurrentDecompressions(n int) Option {
+	return func(o *Options) {
+		o.MaxConcurrentDecompressions = n
+	}
+}
+
+// WithMaxCompressedRequestSize answers requests whose deflate encoded body is
+// larger than size bytes with 413 before inflating them. Set
+// DeflateSrvMiddleware.ContinueHandler as the ContinueHandler of the engine to
+// refuse them before clients using Expect: 100-continue send the body.
+func WithMaxCompressedRequestSize(size int) Option {
+	return func(o *Options) {
+		o.MaxCompressedRequestSize = size
+	}
+}
+
+// WithDecompressionLimitStatus customize the status code answered when the
+// decompression limit or the InflateLimits are exceeded, 503 by default
+func WithDecompressionLimitStatus(code int) Option {
+	return func(o *Options) {
+		o.DecompressionLimitStatus = code
+	}
+}
+
+// WithHeaderLimits customize the maximum length and number of codings of the
+// Accept-Encoding and Content-Encoding headers, beyond which they are ignored.
+// Non-positive values disable the corresponding limit.
+func WithHeaderLimits(maxLength, maxTokens int) Option {
+	return func(o *Options) {
+		o.MaxEncodingHeaderLength = maxLength
+		o.MaxEncodingTokens = maxTokens
+	}
+}
+
+// WithProxyMode is meant for gateways: responses already encoded upstream are
+// forwarded unchanged when the client accepts their encoding, and gzip ones are
+// transcoded to deflate otherwise, instead of being compressed again
+func WithProxyMode() Option {
+	return func(o *Options) {
+		o.ProxyMode = true
+	}
+}
+
+// WithCDNMode tunes the middleware for servers behind a CDN or a shared cache:
+// Vary: Accept-Encoding is merged into the Vary set by the handler, responses
+// with Cache-Control: no-transform, range requests, 206 and 304 responses are
+// left untouched, and compression is disabled for requests carrying one of
+// skipHeaders, e.g. X-Edge-Compressed, when the edge compresses itself.
+func WithCDNMode(skipHeaders ...string) Option {
+	return func(o *Options) {
+		o.CDNMode = true
+		o.CDNSkipHeaders = skipHeaders
+	}
+}
+
+// WithErrorHook customize the function called when a response can't be
+// compressed because of err. The response is then sent as it is.
+func WithErrorHook(fn func(c *app.RequestContext, err error)) Option {
+	return func(o *Options) {
+		o.ErrorHook = fn
+	}
+}
+
+// WithHTTP10Compression negotiates HTTP/1.0 requests like HTTP/1.1 ones. By
+// default they are only compressed when their Accept-Encoding names deflate.
+func WithHTTP10Compression() Option {
+	return func(o *Options) {
+		o.CompressHTTP10 = true
+	}
+}
+
+// WithExcludedRouteNames customize excluded routes, matched against the name of
+// the route handler, as given to GETEX and the like or its function name such
+// as main.getBook, or the route full path such as /books/:id
+func WithExcludedRouteNames(names []string) Option {
+	return func(o *Options) {
+		o.ExcludedRouteNames = make(map[string]bool, len(names))
+		for _, name := range names {
+			o.ExcludedRouteNames[name] = true
+		}
+	}
+}
+
+// WithOriginalLengthHeader sets the X-Original-Content-Length header of the
+// compressed responses to the size of their body before compression
+func WithOriginalLengthHeader() Option {
+	return func(o *Options) {
+		o.OriginalLengthHeader = true
+	}
+}
+
+// WithChunkedResponses sends compressed responses with chunked transfer
+// encoding instead of a Content-Length
+func WithChunkedResponses() Option {
+	return func(o *Options) {
+		o.ChunkedResponses = true
+	}
+}
+
+// WithMetricsHook customize the function receiving the Stats of every response
+// compression and request decompression, failed ones included
+func WithMetricsHook(fn func(c *app.RequestContext, stats Stats)) Option {
+	return func(o *Options) {
+		o.MetricsHook = fn
+	}
+}
+
+// WithContentTypeLevels customize the compression level per response media
+// type, e.g. {"text/html": 9, "application/json": 4}. Other media types use the
+// middleware level.
+func WithContentTypeLevels(levels map[string]int) Option {
+	return func(o *Options) {
+		o.ContentTypeLevels = make(map[string]int, len(levels))
+		for mediaType, level := range levels {
+			o.ContentTypeLevels[strings.ToLower(mediaType)] = level
+		}
+	}
+}
+
+// WithCompressFn customize the function compressing response bodies, which must
+// append the deflate (zlib) encoding of src to dst. Negotiation and headers are
+// still handled by the middleware, padding is left to fn. Streamed bodies keep
+// being compressed by the built-in encoder.
+func WithCompressFn(fn func(dst, src []byte, level int) ([]byte, error)) Option {
+	return func(o *Options) {
+		o.CompressFn = fn
+	}
+}
+
+// WithDryRun compresses response bodies only to measure them: responses are sent
+// uncompressed, with the compressed size in the X-Dry-Run-Compressed-Length
+// header and in the Stats passed to the metrics hook
+func WithDryRun() Option {
+	return func(o *Options) {
+		o.DryRun = true
+	}
+}
+
+// WithExcludedSizeRange leaves response bodies smaller than min or larger than
+// max bytes uncompressed, a non-positive max sets no upper bound. Streamed
+// bodies are only checked when their Content-Length is known.
+func WithExcludedSizeRange(min, max int) Option {
+	return func(o *Options) {
+		o.MinSize = min
+		o.MaxSize = max
+	}
+}
+
+// WithParallelCompression compresses streamed response bodies whose
+// Content-Length exceeds threshold bytes on several goroutines, see
+// compress.ParallelDeflateWriter
+func WithParallelCompression(threshold int) Option {
+	return func(o *Options) {
+		o.ParallelThreshold = threshold
+	}
+}
+
+// WithStreamBufferSize reads streamed response bodies at most size bytes at a
+// time, only once the client has taken what was compressed so far: slow
+// clients hold back the body stream of the handler instead of growing buffers.
+// It defaults to 32 KiB. Parallel compression buffers whole blocks regardless.
+func WithStreamBufferSize(size int) Option {
+	return func(o *Options) {
+		o.StreamBufferSize = size
+	}
+}
+
+// WithRouteStats counts the compressed and skipped responses of each route in
+// stats, to find the routes where exclusions or thresholds are misconfigured
+func WithRouteStats(stats *RouteStats) Option {
+	return func(o *Options) {
+		o.RouteStats = stats
+	}
+}
+
+// WithPolicyFn customize the compression of each request with the Policy
+// returned by fn, called before the handler, e.g. from the tenant or API key
+// set by earlier middlewares
+func WithPolicyFn(fn func(c *app.RequestContext) Policy) Option {
+	return func(o *Options) {
+		o.PolicyFn = fn
+	}
+}
+
+// WithKeepOriginalBody keeps a copy of the uncompressed body of compressed
+// responses under OriginalBodyKey, for the middlewares running after Next.
+// Streamed bodies aren't kept.
+func WithKeepOriginalBody() Option {
+	return func(o *Options) {
+		o.KeepOriginalBody = true
+	}
+}
+
+// WithCompressedBodyHook calls fn with the final compressed body of each
+// compressed response, once its headers are set and before it is written, e.g.
+// to sign the compressed bytes. fn may set headers but must not modify body.
+// Streamed bodies aren't passed to fn.
+func WithCompressedBodyHook(fn func(c *app.RequestContext, body []byte)) Option {
+	return func(o *Options) {
+		o.CompressedBodyHook = fn
+	}
+}
+
+// WithConsumeAcceptEncoding removes the Accept-Encoding header from the
+// requests the middleware compresses the response of, before the handler runs,
+// so that a handler proxying upstream doesn't get an encoded response to be
+// encoded again
+func WithConsumeAcceptEncoding() Option {
+	return func(o *Options) {
+		o.ConsumeAcceptEncoding = true
+	}
+}
+
+// WithStreamTrailers sends the size and CRC-32 of streamed response bodies
+// before compression as the X-Uncompressed-Length and X-Uncompressed-Crc32
+// trailers, so clients can check that long downloads are complete
+func WithStreamTrailers() Option {
+	return func(o *Options) {
+		o.StreamTrailers = true
+	}
+}
+
+// WithLenientDecompression passes request bodies labeled deflate which aren't
+// compressed through to the handler untouched, marked under MislabeledBodyKey,
+// instead of failing their decompression. Streamed bodies aren't checked.
+func WithLenientDecompression() Option {
+	return func(o *Options) {
+		o.LenientDecompression = true
+	}
+}
+
+// WithFinalWriter compresses responses when the server writes them rather than
+// when the next handlers return, so that bodies set by the middlewares
+// registered before this one, e.g. recovery pages or authentication errors,
+// are compressed as well, aborted responses included. It works through the
+// hijack writer of the response, so it only applies to HTTP/1 requests, HTTP/2
+// ones being compressed when the next handlers return, and handlers installing
+// their own hijack writer opt out of it. So do bodies set after the response is
+// reset, e.g. by c.AbortWithMsg, as c.Response.Reset drops the hijack writer.
+func WithFinalWriter() Option {
+	return func(o *Options) {
+		o.FinalWriter = true
+	}
+}
+
+// WithPools compresses responses with the writers of pools rather than the
+// global pools shared by every middleware, e.g. compress.NewPools() to give an
+// engine its own. Padded, transcoded and streamed responses still use the
+// global pools.
+func WithPools(pools *compress.Pools) Option {
+	return func(o *Options) {
+		o.Pools = pools
+	}
+}
+
+// WithIncludedContentTypes only compresses the responses with one of the given
+// media types, e.g. application/json
+func WithIncludedContentTypes(mediaTypes []string) Option {
+	return func(o *Options) {
+		o.IncludedContentTypes = make(map[string]bool, len(mediaTypes))
+		for _, mediaType := range mediaTypes {
+			o.IncludedContentTypes[strings.ToLower(mediaType)] = true
+		}
+	}
+}
+
+// rpcContentTypes are the media types of the JSON, Protobuf and Thrift
+// payloads compressed by WithRPCDefaults
+var rpcContentTypes = []string{
+	"application/json",
+	"application/x-protobuf", "application/protobuf",
+	"application/x-thrift", "application/vnd.apache.thrift.binary",
+	"application/vnd.apache.thrift.compact", "application/vnd.apache.thrift.json",
+}
+
+// rpcMinSize is the size under which WithRPCDefaults leaves bodies uncompressed
+const rpcMinSize = 512
+
+// WithRPCDefaults tunes the middleware for RPC-over-HTTP gateways: only JSON,
+// Protobuf and Thrift responses of at least 512 bytes are compressed, at
+// BestSpeed, leaving images and streams alone. Options given after it
+// override its settings.
+func WithRPCDefaults() Option {
+	return func(o *Options) {
+		WithLevel(BestSpeed)(o)
+		WithExcludedSizeRange(rpcMinSize, 0)(o)
+		WithIncludedContentTypes(rpcContentTypes)(o)
+	}
+}
+
+// WithVariantHook calls fn with the Variant of every response once the
+// middleware is done with it, so cache middlewares can store it under its
+// Variant.Key and look it up with Options.VariantKey
+func WithVariantHook(fn func(c *app.RequestContext, v Variant)) Option {
+	return func(o *Options) {
+		o.VariantHook = fn
+	}
+}
+
+// WithSpooling compresses response bodies larger than threshold bytes to a
+// temporary file created in dir, os.TempDir() when empty, once the compressed
+// body exceeds threshold too, so that it doesn't take memory on top of the
+// body. The file is removed once the response is sent. It doesn't apply with
+// WithCompressFn, padding, WithDryRun or WithCompressedBodyHook, and
+// IntegrityRecompute drops the integrity headers of spooled responses.
+func WithSpooling(threshold int, dir string) Option {
+	return func(o *Options) {
+		o.SpoolThreshold = threshold
+		o.SpoolDir = dir
+	}
+}
+
+// WithExcludedMethods replaces DefaultExcludedMethods, the methods of the
+// requests whose responses are neither compressed nor given a Vary header.
+// Passing none compresses the responses to every method.
+func WithExcludedMethods(methods []string) Option {
+	return func(o *Options) {
+		o.ExcludedMethods = make(map[string]bool, len(methods))
+		for _, method := range methods {
+			o.ExcludedMethods[strings.ToUpper(method)] = true
+		}
+	}
+}
+
+// WithExplicitIdentity sets Content-Encoding: identity and Vary on the responses
+// left uncompressed because the client doesn't accept deflate, for strict
+// clients and caches. It has no effect with a ShouldCompressFunc.
+func WithExplicitIdentity() Option {
+	return func(o *Options) {
+		o.ExplicitIdentity = true
+	}
+}
+
+// WithInflateLimits bounds the request bodies inflated by DefaultDecompressHandle
+// and StreamingDecompressHandle, compress.DefaultInflateLimits by default. Requests
+// exceeding them are answered with DecompressionLimitStatus, except for streamed
+// bodies whose reads fail with compress.ErrInflateLimit.
+func WithInflateLimits(limits compress.InflateLimits) Option {
+	return func(o *Options) {
+		o.InflateLimits = limits
+	}
+}
+
 func WithDecompressFnForClient(decompressFnForClient client.Middleware) ClientOption {
 	return func(o *ClientOptions) {
 		o.DecompressFnForClient = decompressFnForClient
 	}
 }
 
-// WithExcludedExtensionsForClient customize excluded extensions
+// WithExcludedExtensionsForClient customize excluded extensions, e.g. .png, or file name patterns such as *.min.js
 func WithExcludedExtensionsForClient(args []string) ClientOption {
 	return func(o *ClientOptions) {
 		o.ExcludedExtensions = NewExcludedExtensions(args)
@@ -109,6 +662,117 @@ func WithExcludedPathsForClient(args []string) ClientOption {
 	}
 }
 
+// WithAdaptiveLevelForClient picks the compression level by request body size
+func WithAdaptiveLevelForClient() ClientOption {
+	return func(o *ClientOptions) {
+		o.AdaptiveLevel = true
+	}
+}
+
+// WithMemoryBudgetForClient bounds the original and compressed bytes buffered
+// across concurrent requests until they are sent. Streamed uploads aren't counted.
+func WithMemoryBudgetForClient(budget *MemoryBudget) ClientOption {
+	return func(o *ClientOptions) {
+		o.MemoryBudget = budget
+	}
+}
+
+// WithoutVaryHeaderForClient stops emitting Vary: Accept-Encoding on compressed requests
+func WithoutVaryHeaderForClient() ClientOption {
+	return func(o *ClientOptions) {
+		o.DisableVary = true
+	}
+}
+
+// WithLegacyEncodingsForClient decompresses responses encoded as x-deflate as well
+func WithLegacyEncodingsForClient() ClientOption {
+	return func(o *ClientOptions) {
+		o.LegacyEncodings = true
+	}
+}
+
+// WithStreamingUploadsForClient compresses request bodies while they are sent
+// with chunked transfer encoding instead of buffering the compressed body, and
+// sends the size and CRC-32 of the body as the X-Uncompressed-Length and
+// X-Uncompressed-Crc32 trailers. The server must accept chunked requests, and
+// requests with a streamed body can't be retried.
+func WithStreamingUploadsForClient() ClientOption {
+	return func(o *ClientOptions) {
+		o.StreamingUploads = true
+	}
+}
+
+// WithDecompressContentTypesForClient inflates the responses with one of the
+// given media types, e.g. application/zlib or application/x-deflate, even
+// without a Content-Encoding header. Their Content-Type is then replaced by
+// application/octet-stream.
+func WithDecompressContentTypesForClient(mediaTypes []string) ClientOption {
+	return func(o *ClientOptions) {
+		o.DecompressContentTypes = make(map[string]bool, len(mediaTypes))
+		for _, mediaType := range mediaTypes {
+			o.DecompressContentTypes[strings.ToLower(mediaType)] = true
+		}
+	}
+}
+
+// WithMetricsHookForClient customize the function receiving the ClientStats of
+// every request whose body was compressed, failed ones included, e.g. to detect
+// servers which stopped accepting compressed bodies
+func WithMetricsHookForClient(fn func(req *protocol.Request, resp *protocol.Response, stats ClientStats)) ClientOption {
+	return func(o *ClientOptions) {
+		o.MetricsHook = fn
+	}
+}
+
+// WithAcceptanceFuncForClient customize how ClientStats.Accepted is decided,
+// e.g. from an application error code of the response. It defaults to
+// DefaultAcceptanceFunc.
+func WithAcceptanceFuncForClient(fn func(req *protocol.Request, resp *protocol.Response) bool) ClientOption {
+	return func(o *ClientOptions) {
+		o.AcceptanceFunc = fn
+	}
+}
+
+// WithIncludedMethodsForClient only compresses the body of requests with one of
+// the given methods, e.g. POST, PUT and PATCH
+func WithIncludedMethodsForClient(methods []string) ClientOption {
+	return func(o *ClientOptions) {
+		o.IncludedMethods = make(map[string]bool, len(methods))
+		for _, method := range methods {
+			o.IncludedMethods[strings.ToUpper(method)] = true
+		}
+	}
+}
+
+// WithRestoreBodyForClient sets the original body and headers back on the
+// request once Do returns, so it can be sent again or cloned as is. Bodies
+// sent with WithStreamingUploadsForClient aren't restored.
+func WithRestoreBodyForClient() ClientOption {
+	return func(o *ClientOptions) {
+		o.RestoreBody = true
+	}
+}
+
+// WithChunkedUploadsForClient sends compressed request bodies with chunked
+// transfer encoding instead of a Content-Length, for servers and proxies which
+// handle streamed uploads better. The body is still compressed before being
+// sent, see WithStreamingUploadsForClient to compress it while it is sent.
+// Like streamed bodies, chunked bodies can't be sent again by retries.
+func WithChunkedUploadsForClient() ClientOption {
+	return func(o *ClientOptions) {
+		o.ChunkedUploads = true
+	}
+}
+
+// WithPoolsForClient compresses request bodies with the writers of pools
+// rather than the global pools, see WithPools. Streamed uploads still use the
+// global pools.
+func WithPoolsForClient(pools *compress.Pools) ClientOption {
+	return func(o *ClientOptions) {
+		o.Pools = pools
+	}
+}
+
 func NewExcludedPaths(paths []string) ExcludedPaths {
 	return ExcludedPaths(paths)
 }
@@ -143,6 +807,24 @@ func (e ExcludedExtensions) Contains(target string) bool {
 	return ok
 }
 
+// Matches reports whether the extension of requestURI is excluded, or its file
+// name matches one of the excluded patterns holding a *, such as *.min.js or *.min.*
+func (e ExcludedExtensions) Matches(requestURI string) bool {
+	uriPath, _, _ := strings.Cut(requestURI, "?")
+	if e.Contains(path.Ext(uriPath)) {
+		return true
+	}
+	name := path.Base(uriPath)
+	for pattern := range e {
+		if strings.Contains(pattern, "*") {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (e ExcludedPaths) Contains(requestURI string) bool {
 	for _, path := range e {
 		if strings.HasPrefix(requestURI, path) {
@@ -152,11 +834,42 @@ func (e ExcludedPaths) Contains(requestURI string) bool {
 	return false
 }
 
+// inflateBody inflates a body labeled deflate within limits, recovering gzip
+// bodies sent with the wrong Content-Encoding
+func inflateBody(body []byte, limits compress.InflateLimits) ([]byte, error) {
+	if compress.DetectEncoding(body) != compress.EncodingGzip {
+		return compress.AppendInflateBytesLimit(nil, body, limits)
+	}
+	return compress.AppendGunzipBytesLimit(nil, body, limits)
+}
+
+// inflateLimitsKey is the RequestContext key of the InflateLimits the
+// middleware sets for its DecompressFn
+const inflateLimitsKey = "deflate.inflate_limits"
+
+// inflateLimits returns the InflateLimits of the middleware running c,
+// compress.DefaultInflateLimits outside of one
+func inflateLimits(c *app.RequestContext) compress.InflateLimits {
+	if v, ok := c.Get(inflateLimitsKey); ok {
+		return v.(compress.InflateLimits)
+	}
+	return compress.DefaultInflateLimits
+}
+
+// DefaultDecompressHandle is the DecompressFn inflating the request body in
+// memory, within the InflateLimits of the middleware. Multipart forms are
+// inflated by StreamingDecompressHandle instead, so that the multipart reader of
+// c.MultipartForm() spools their files to disk as they are inflated rather than
+// holding the whole inflated form.
 func DefaultDecompressHandle(ctx context.Context, c *app.RequestContext) {
+	if len(c.Request.Header.MultipartFormBoundary()) > 0 {
+		StreamingDecompressHandle(ctx, c)
+		return
+	}
 	if len(c.Request.Body()) <= 0 {
 		return
 	}
-	inflateBytes, err := compress.AppendInflateBytes(nil, c.Request.Body())
+	inflateBytes, err := inflateBody(c.Request.Body(), inflateLimits(c))
 	if err != nil {
 		_ = c.AbortWithError(http.StatusBadRequest, err)
 		return
@@ -166,12 +879,39 @@ func DefaultDecompressHandle(ctx context.Context, c *app.RequestContext) {
 	c.Request.SetBody(inflateBytes)
 }
 
+// StreamingDecompressHandle is a DecompressFn inflating the request body while
+// the handler reads it from c.Request.BodyStream(), so the inflated body is never
+// held in memory as a whole. With server.WithStreamBody(true) the compressed body
+// isn't buffered either. Handlers calling c.Request.Body() still materialize it.
+// Reads fail with compress.ErrInflateLimit beyond the InflateLimits of the
+// middleware.
+func StreamingDecompressHandle(ctx context.Context, c *app.RequestContext) {
+	var src io.Reader
+	if c.Request.IsBodyStream() {
+		src = c.Request.BodyStream()
+	} else if body := c.Request.Body(); len(body) > 0 {
+		src = bytes.NewReader(body)
+	} else {
+		return
+	}
+	zr, err := compress.NewPooledInflateReadCloserLimit(src, inflateLimits(c))
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	c.Request.Header.DelBytes([]byte("Content-Encoding"))
+	c.Request.Header.DelBytes([]byte("Content-Length"))
+	// SetBodyStream would close the stream being wrapped
+	c.Request.ConstructBodyStream(nil, zr)
+}
+
 func DefaultDecompressMiddlewareForClient(next client.Endpoint) client.Endpoint {
 	return func(ctx context.Context, req *protocol.Request, resp *protocol.Response) (err error) {
 		if len(resp.Body()) <= 0 {
 			return
 		}
-		inflateBytes, err := compress.AppendInflateBytes(nil, resp.Body())
+		// responses come from the upstream the client chose, they aren't bounded
+		inflateBytes, err := inflateBody(resp.Body(), compress.InflateLimits{})
 		if err != nil {
 			return err
 		}
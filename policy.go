@@ -0,0 +1,39 @@
+package deflate
+
+import (
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+// policyLevelKey is the RequestContext key of the level set by the PolicyFn
+const policyLevelKey = "deflate.policy.level"
+
+// Policy is the compression policy of a request, see WithPolicyFn
+type Policy struct {
+	// Disable leaves the response uncompressed
+	Disable bool
+	// Level replaces the configured level when SetLevel is true. A level
+	// stored under LevelContextKey by the handler still takes precedence.
+	Level    int
+	SetLevel bool
+	// Codec is the content coding to use. Only deflate is supported: the
+	// responses of any other codec are left uncompressed.
+	Codec string
+}
+
+// applyPolicy applies the policy returned by the PolicyFn and reports whether
+// the response may be compressed
+func (d *DeflateSrvMiddleware) applyPolicy(c *app.RequestContext) bool {
+	if d.PolicyFn == nil {
+		return true
+	}
+	policy := d.PolicyFn(c)
+	if policy.Disable || policy.Codec != "" && !strings.EqualFold(policy.Codec, "deflate") {
+		return false
+	}
+	if policy.SetLevel {
+		c.Set(policyLevelKey, policy.Level)
+	}
+	return true
+}
@@ -4,70 +4,636 @@ import (
 	"bytes"
 	"context"
 	"deflate/compress"
-	"path/filepath"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
 )
 
-type deflateSrvMiddleware struct {
+// HeaderOriginalContentLength is the header holding the size of a response body before
+// compression, see WithOriginalLengthHeader
+const HeaderOriginalContentLength = "X-Original-Content-Length"
+
+// HeaderDryRunCompressedLength is the header holding the size the response
+// body would have once compressed, see WithDryRun
+const HeaderDryRunCompressedLength = "X-Dry-Run-Compressed-Length"
+
+// HeaderUncompressedLength and HeaderUncompressedCRC32 are the trailers holding
+// the size and the hex CRC-32 of a streamed response body before compression,
+// see WithStreamTrailers
+const (
+	HeaderUncompressedLength = "X-Uncompressed-Length"
+	HeaderUncompressedCRC32  = "X-Uncompressed-Crc32"
+)
+
+// defaultContentType is what Hertz reports when a handler sets no Content-Type
+var defaultContentType = []byte("text/plain; charset=utf-8")
+
+// DeflateSrvMiddleware is the server middleware returned by Deflate. It can be
+// embedded to customize its decisions, e.g. by setting ShouldCompressFunc.
+type DeflateSrvMiddleware struct {
 	*Options
-	level int
+
+	// ShouldCompressFunc replaces ShouldCompress when set
+	ShouldCompressFunc func(req *protocol.Request) bool
+
+	decompressions chan struct{}
+	updated        atomic.Pointer[DeflateSrvMiddleware]
+	// root is the middleware UpdateOptions was called on
+	root *DeflateSrvMiddleware
 }
 
-func newDeflateSrvMiddleware(level int, opts ...Option) *deflateSrvMiddleware {
-	handler := &deflateSrvMiddleware{
-		Options: DefaultOptions,
-		level:   level,
+func NewDeflateSrvMiddleware(level int, opts ...Option) *DeflateSrvMiddleware {
+	options := *DefaultOptions
+	options.Level = level
+	handler := &DeflateSrvMiddleware{
+		Options: &options,
 	}
 	for _, fn := range opts {
 		fn(handler.Options)
 	}
+	handler.excludedPathTrie = compilePaths(handler.ExcludedPaths)
+	if n := handler.MaxConcurrentDecompressions; n > 0 {
+		handler.decompressions = make(chan struct{}, n)
+	}
 	return handler
 }
 
-func (d *deflateSrvMiddleware) SrvMiddleware(ctx context.Context, c *app.RequestContext) {
-	if fn := d.DecompressFn; fn != nil && strings.EqualFold(c.Request.Header.Get("Content-Encoding"), "deflate") {
-		fn(ctx, c)
+// UpdateOptions applies opts on top of the current options and atomically
+// swaps them in: requests already running finish with the options they
+// started with. ShouldCompressFunc is captured as set at the time of the call.
+// Concurrent calls must be serialized by the caller.
+func (d *DeflateSrvMiddleware) UpdateOptions(opts ...Option) {
+	current := d.current()
+	options := *current.Options
+	for _, fn := range opts {
+		fn(&options)
+	}
+	options.excludedPathTrie = compilePaths(options.ExcludedPaths)
+	next := &DeflateSrvMiddleware{
+		Options:            &options,
+		ShouldCompressFunc: d.ShouldCompressFunc,
+		decompressions:     current.decompressions,
+		root:               d,
 	}
-	if !d.shouldCompress(&c.Request) {
+	if n := options.MaxConcurrentDecompressions; n != current.MaxConcurrentDecompressions {
+		next.decompressions = nil
+		if n > 0 {
+			next.decompressions = make(chan struct{}, n)
+		}
+	}
+	d.updated.Store(next)
+}
+
+// CurrentOptions returns the options in use, as last set by UpdateOptions.
+// They must not be modified.
+func (d *DeflateSrvMiddleware) CurrentOptions() *Options {
+	return d.current().Options
+}
+
+// owner returns the middleware the options of d were set on, the one the
+// handlers know
+func (d *DeflateSrvMiddleware) owner() *DeflateSrvMiddleware {
+	if d.root != nil {
+		return d.root
+	}
+	return d
+}
+
+// current returns the middleware holding the options in use
+func (d *DeflateSrvMiddleware) current() *DeflateSrvMiddleware {
+	if updated := d.updated.Load(); updated != nil {
+		return updated
+	}
+	return d
+}
+
+func (d *DeflateSrvMiddleware) SrvMiddleware(ctx context.Context, c *app.RequestContext) {
+	current := d.current()
+	current.serve(ctx, c)
+	// the final writer reports the response once it is compressed
+	if _, final := c.Response.GetHijackWriter().(*finalWriter); !final {
+		current.finish(c)
+	}
+}
+
+// finish reports the response of c to RouteStats and the VariantHook
+func (d *DeflateSrvMiddleware) finish(c *app.RequestContext) {
+	if d.RouteStats != nil {
+		d.RouteStats.record(c)
+	}
+	if d.VariantHook != nil {
+		encoding := c.Response.Header.Get("Content-Encoding")
+		if encoding == "" {
+			encoding = "identity"
+		}
+		d.VariantHook(c, Variant{Key: d.VariantKey(requestAcceptEncoding(c)), Encoding: encoding})
+	}
+}
+
+func (d *DeflateSrvMiddleware) serve(ctx context.Context, c *app.RequestContext) {
+	if fn := d.DecompressFn; fn != nil && d.isDeflateEncoded(c.Request.Header.Get("Content-Encoding")) {
+		if d.exceedsCompressedSize(&c.Request) {
+			c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+			return
+		}
+		// the ContinueHandler refused the body, which wasn't read
+		if c.Request.MayContinue() && c.Response.StatusCode() == http.StatusExpectationFailed {
+			c.Abort()
+			return
+		}
+		if d.LenientDecompression && isMislabeledBody(&c.Request) {
+			c.Set(MislabeledBodyKey, true)
+		} else if !d.decompress(ctx, c, fn) {
+			c.AbortWithStatus(d.DecompressionLimitStatus)
+			return
+		}
+	}
+	var ok bool
+	var reason string
+	if d.ShouldCompressFunc != nil {
+		ok = d.ShouldCompressFunc(&c.Request)
+	} else {
+		ok, reason = ShouldCompress(d.Options, &c.Request)
+	}
+	if !ok {
+		if d.ExplicitIdentity && (reason == ReasonNotAccepted || reason == ReasonHTTP10) {
+			c.Next(ctx)
+			d.setIdentityHeaders(c)
+		}
+		return
+	}
+	if d.isExcludedRoute(c) || !d.applyPolicy(c) || !ClaimCompression(c) {
+		return
+	}
+	c.Set(claimOwnerKey, d.owner())
+	if d.ConsumeAcceptEncoding {
+		consumeAcceptEncoding(c)
+	}
+
+	if d.FinalWriter && !isHTTP2(&c.Request) {
+		c.Response.HijackWriter(&finalWriter{d: d, c: c})
+		c.Next(ctx)
 		return
 	}
 
 	c.Next(ctx)
 
-	c.Header("Content-Encoding", "deflate")
-	c.Header("Vary", "Accept-Encoding")
-	if len(c.Response.Body()) > 0 {
-		deflateBytes, err := compress.AppendDeflateBytesLevel(nil, c.Response.Body(), d.level)
-		if err != nil {
+	// an aborted response, e.g. an error written by an auth middleware, is sent
+	// as the handler left it, and nobody will read the body of a canceled request
+	if c.IsAborted() || ctx.Err() != nil {
+		return
+	}
+	d.compressResponse(c)
+}
+
+// compressResponse compresses the response written by the next handlers
+func (d *DeflateSrvMiddleware) compressResponse(c *app.RequestContext) {
+	if optedOut(c) {
+		return
+	}
+	if IsResponseEncoded(&c.Response) {
+		if d.ProxyMode {
+			d.proxyEncoded(c, c.Response.Header.Get("Content-Encoding"))
+		}
+		return
+	}
+	// a 304 stands for the deflate representation the client has cached,
+	// except for CDNs which cache the identity one
+	if c.Response.StatusCode() == http.StatusNotModified {
+		if !d.CDNMode {
+			d.rewriteETag(c)
+		}
+		return
+	}
+	if isMediaType(c.Response.Header.ContentType(), "text/event-stream") {
+		return
+	}
+	if len(d.IncludedContentTypes) > 0 && !d.isIncludedContentType(c.Response.Header.ContentType()) {
+		return
+	}
+	if d.CDNMode && d.cdnSkip(c) {
+		return
+	}
+	if d.SecretAwareSkip != nil && d.SecretAwareSkip(c) {
+		return
+	}
+	if c.Response.GetHijackWriter() != nil {
+		return
+	}
+	if c.Response.IsBodyStream() {
+		if size := c.Response.Header.ContentLength(); size >= 0 && d.isExcludedSize(size) {
 			return
 		}
-		c.Response.SetBodyStream(bytes.NewBuffer(deflateBytes), len(deflateBytes))
+		d.compressStream(c)
+		return
+	}
+	if d.EntropyThreshold > 0 && sampleEntropy(c.Response.Body()) > d.EntropyThreshold {
+		return
+	}
+	if d.SniffContentType && !hasExplicitContentType(&c.Response) && sniffIncompressible(c.Response.Body()) {
+		return
+	}
+
+	body := c.Response.Body()
+	if len(body) == 0 || d.isExcludedSize(len(body)) {
+		return
+	}
+	// the reservation is released once the compressed body is sent
+	reserved, ok := reserve(d.MemoryBudget, 2*len(body))
+	if !ok {
+		return
+	}
+	defer reserved.release()
+
+	if d.SpoolThreshold > 0 && len(body) > d.SpoolThreshold && d.spoolable() {
+		d.compressSpooled(c, body, reserved)
+		return
+	}
+
+	start := time.Now()
+	deflateBytes, err := d.compressBody(body, d.levelFor(c, len(body)))
+	d.report(c, start, Stats{
+		Operation:        OperationCompress,
+		CompressedSize:   len(deflateBytes),
+		UncompressedSize: len(body),
+		Err:              err,
+		DryRun:           d.DryRun,
+	})
+	if err != nil {
+		d.onError(c, err)
+		return
+	}
+	if d.DryRun {
+		c.Response.Header.Set(HeaderDryRunCompressedLength, strconv.Itoa(len(deflateBytes)))
+		return
+	}
+	d.setEncodingHeaders(c)
+	if d.KeepOriginalBody {
+		// body is released together with the response buffer
+		c.Set(OriginalBodyKey, append([]byte(nil), body...))
+	}
+	if d.OriginalLengthHeader {
+		c.Response.Header.Set(HeaderOriginalContentLength, strconv.Itoa(len(body)))
+	}
+	d.setDeflateBody(c, deflateBytes, reserved)
+}
+
+// spoolable reports whether responses may be compressed by compressSpooled,
+// which neither pads nor calls CompressFn, and doesn't know the compressed body
+func (d *DeflateSrvMiddleware) spoolable() bool {
+	return d.CompressFn == nil && d.RandomPadding <= 0 && d.PaddingBlock <= 1 &&
+		!d.DryRun && d.CompressedBodyHook == nil
+}
+
+// onError reports an error which left the response uncompressed to the ErrorHook
+// and adds it to the errors of c, for the error logging middlewares
+func (d *DeflateSrvMiddleware) onError(c *app.RequestContext, err error) {
+	_ = c.Error(err)
+	if d.ErrorHook != nil {
+		d.ErrorHook(c, err)
+	}
+}
+
+// setEncodingHeaders sets the Content-Encoding of a compressed response and its Vary header.
+// Compression is always a content coding: TE: deflate can't be honored as Hertz
+// manages Transfer-Encoding itself, rewriting it to chunked when writing the response.
+func (d *DeflateSrvMiddleware) setEncodingHeaders(c *app.RequestContext) {
+	c.Set(compressedKey, true)
+	c.Header("Content-Encoding", acceptedToken(requestAcceptEncoding(c), "deflate", d.LegacyEncodings))
+	switch {
+	case d.CDNMode:
+		addVary(&c.Response.Header, "Accept-Encoding")
+	case !d.DisableVary:
+		c.Header("Vary", "Accept-Encoding")
+	}
+}
+
+// setIdentityHeaders asserts that the response of c is sent uncompressed
+// because of the Accept-Encoding of the request, see WithExplicitIdentity
+func (d *DeflateSrvMiddleware) setIdentityHeaders(c *app.RequestContext) {
+	if c.IsAborted() || len(c.Response.Header.Peek("Content-Encoding")) > 0 {
+		return
+	}
+	c.Header("Content-Encoding", "identity")
+	switch {
+	case d.CDNMode:
+		addVary(&c.Response.Header, "Accept-Encoding")
+	case !d.DisableVary:
+		c.Header("Vary", "Accept-Encoding")
+	}
+}
+
+// setDeflateBody replaces the response body by deflateBytes, adjusting the
+// headers derived from the body. reserved is released once the body is sent.
+func (d *DeflateSrvMiddleware) setDeflateBody(c *app.RequestContext, deflateBytes []byte, reserved *reservation) {
+	size := len(deflateBytes)
+	if d.ChunkedResponses {
+		size = -1
+	}
+	c.Response.SetBodyStream(&budgetReader{Reader: bytes.NewBuffer(deflateBytes), r: reserved.take()}, size)
+	rewriteIntegrityHeaders(&c.Response.Header, deflateBytes, d.IntegrityPolicy)
+	d.rewriteETag(c)
+	if d.CompressedBodyHook != nil {
+		d.CompressedBodyHook(c, deflateBytes)
+	}
+}
+
+// proxyEncoded handles a response already encoded by an upstream: it is passed
+// through when the client accepts its encoding, gzip is transcoded to deflate
+// otherwise, and other encodings are left as they are. The gzip body is inflated
+// within the InflateLimits, and sent uncompressed when its inflated size is out
+// of the MinSize..MaxSize range.
+func (d *DeflateSrvMiddleware) proxyEncoded(c *app.RequestContext, encoding string) {
+	header := requestAcceptEncoding(c)
+	if acceptsEncoding(header, strings.ToLower(encoding)) || !isContentEncoding(encoding, "gzip", true) {
+		return
+	}
+	body, err := compress.AppendGunzipBytesLimit(nil, c.Response.Body(), d.InflateLimits)
+	if err != nil {
+		d.onError(c, err)
+		return
+	}
+	if d.isExcludedSize(len(body)) {
+		c.Response.Header.Del("Content-Encoding")
+		c.Response.SetBody(body)
+		return
+	}
+	reserved, ok := reserve(d.MemoryBudget, 2*len(body))
+	if !ok {
+		return
+	}
+	defer reserved.release()
+	deflateBytes, err := d.compressBody(body, d.levelFor(c, len(body)))
+	if err != nil {
+		d.onError(c, err)
+		return
+	}
+	d.setEncodingHeaders(c)
+	d.setDeflateBody(c, deflateBytes, reserved)
+}
+
+func (d *DeflateSrvMiddleware) compressBody(body []byte, level int) ([]byte, error) {
+	if d.CompressFn != nil {
+		return d.CompressFn(nil, body, level)
+	}
+	if d.RandomPadding <= 0 && d.PaddingBlock <= 1 {
+		if d.Pools != nil {
+			return d.Pools.AppendDeflateBytesLevel(nil, body, level)
+		}
+		return compress.AppendDeflateBytesLevel(nil, body, level)
 	}
+	return compress.AppendDeflateBytesLevelPaddedFunc(nil, body, level, func(n int) int {
+		padding := 0
+		if d.RandomPadding > 0 {
+			padding = compress.PaddingSize(rand.IntN(d.RandomPadding + 1))
+		}
+		return padding + compress.BlockPaddingSize(n+padding, d.PaddingBlock)
+	})
 }
 
-func (d *deflateSrvMiddleware) shouldCompress(req *protocol.Request) bool {
-	if !(strings.Contains(req.Header.Get("Accept-Encoding"), "deflate") ||
-		strings.TrimSpace(req.Header.Get("Accept-Encoding")) == "*") ||
-		strings.Contains(req.Header.Get("Connection"), "Upgrade") ||
-		strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+// decompress runs fn unless MaxConcurrentDecompressions are already running
+func (d *DeflateSrvMiddleware) decompress(ctx context.Context, c *app.RequestContext, fn app.HandlerFunc) bool {
+	if d.decompressions != nil {
+		select {
+		case d.decompressions <- struct{}{}:
+			defer func() { <-d.decompressions }()
+		default:
+			return false
+		}
+	}
+	start := time.Now()
+	compressedSize := c.Request.Header.ContentLength()
+	if compressedSize < 0 && !c.Request.IsBodyStream() {
+		compressedSize = len(c.Request.Body())
+	}
+	c.Set(inflateLimitsKey, d.InflateLimits)
+	fn(ctx, c)
+	if err := c.Errors.Last(); err != nil && c.IsAborted() && errors.Is(err, compress.ErrInflateLimit) {
+		c.Response.SetStatusCode(d.DecompressionLimitStatus)
+	}
+	if d.MetricsHook != nil {
+		stats := Stats{Operation: OperationDecompress, CompressedSize: compressedSize, UncompressedSize: -1}
+		if !c.Request.IsBodyStream() {
+			stats.UncompressedSize = len(c.Request.Body())
+		}
+		if c.IsAborted() {
+			stats.Err = errDecompressionAborted
+			if err := c.Errors.Last(); err != nil {
+				stats.Err = err
+			}
+		}
+		d.report(c, start, stats)
+	}
+	return true
+}
+
+// exceedsCompressedSize reports whether the body of req is larger than
+// MaxCompressedRequestSize
+func (o *Options) exceedsCompressedSize(req *protocol.Request) bool {
+	if o.MaxCompressedRequestSize <= 0 {
 		return false
 	}
+	size := req.Header.ContentLength()
+	if size < 0 && !req.IsBodyStream() {
+		size = len(req.Body())
+	}
+	return size > o.MaxCompressedRequestSize
+}
 
-	path := string(req.URI().RequestURI())
-	extension := filepath.Ext(path)
-	if d.ExcludedExtensions.Contains(extension) {
+// ContinueHandler is meant to be the ContinueHandler of the Hertz engine: it
+// refuses the deflate encoded requests sent with Expect: 100-continue which
+// would be rejected once read, because their Content-Length exceeds
+// MaxCompressedRequestSize or MaxConcurrentDecompressions are running, so
+// clients don't send bodies for nothing. The middleware answers them with 413
+// or 417 without running the next handlers.
+func (d *DeflateSrvMiddleware) ContinueHandler(header *protocol.RequestHeader) bool {
+	current := d.current()
+	if current.DecompressFn == nil || !current.isDeflateEncoded(header.Get("Content-Encoding")) {
+		return true
+	}
+	if max := current.MaxCompressedRequestSize; max > 0 && header.ContentLength() > max {
 		return false
 	}
+	return current.decompressions == nil || len(current.decompressions) < cap(current.decompressions)
+}
 
-	if d.ExcludedPaths.Contains(path) {
+var errDecompressionAborted = errors.New("deflate: request decompression aborted")
+
+// MislabeledBodyKey is the RequestContext key marking a request body labeled
+// deflate but not compressed, passed through by WithLenientDecompression
+const MislabeledBodyKey = "deflate.mislabeled_body"
+
+// isMislabeledBody reports whether the buffered body of req has neither a zlib
+// nor a gzip header
+func isMislabeledBody(req *protocol.Request) bool {
+	if req.IsBodyStream() {
 		return false
 	}
-	if d.ExcludedPathRegexes.Contains(path) {
+	body := req.Body()
+	if len(body) == 0 {
+		return false
+	}
+	switch compress.DetectEncoding(body) {
+	case compress.EncodingDeflate, compress.EncodingGzip:
 		return false
 	}
-
 	return true
 }
+
+// levelFor returns the compression level for a response body of the given size,
+// preferring a level stored under LevelContextKey, then the one of the response
+// Content-Type.
+func (d *DeflateSrvMiddleware) levelFor(c *app.RequestContext, size int) int {
+	if v, ok := c.Get(LevelContextKey); ok {
+		if level, ok := v.(int); ok {
+			return level
+		}
+	}
+	if v, ok := c.Get(policyLevelKey); ok {
+		return v.(int)
+	}
+	if len(d.ContentTypeLevels) > 0 {
+		mediaType, _, _ := strings.Cut(string(c.Response.Header.ContentType()), ";")
+		if level, ok := d.ContentTypeLevels[strings.ToLower(strings.TrimSpace(mediaType))]; ok {
+			return level
+		}
+	}
+	if d.AdaptiveLevel {
+		return adaptiveLevel(d.Level, size)
+	}
+	return d.Level
+}
+
+// isExcludedSize reports whether a body of the given size is out of the
+// MinSize..MaxSize range
+func (d *DeflateSrvMiddleware) isExcludedSize(size int) bool {
+	return size < d.MinSize || d.MaxSize > 0 && size > d.MaxSize
+}
+
+// isIncludedContentType reports whether the media type of contentType is one
+// of the IncludedContentTypes
+func (d *DeflateSrvMiddleware) isIncludedContentType(contentType []byte) bool {
+	mediaType, _, _ := strings.Cut(string(contentType), ";")
+	return d.IncludedContentTypes[strings.ToLower(strings.TrimSpace(mediaType))]
+}
+
+// isExcludedRoute reports whether the route matched by c is excluded by its
+// full path, the name its handler was registered with or the handler function name
+func (d *DeflateSrvMiddleware) isExcludedRoute(c *app.RequestContext) bool {
+	if len(d.ExcludedRouteNames) == 0 {
+		return false
+	}
+	if d.ExcludedRouteNames[c.FullPath()] {
+		return true
+	}
+	handler := c.Handler()
+	if handler == nil {
+		return false
+	}
+	return d.ExcludedRouteNames[app.GetHandlerName(handler)] || d.ExcludedRouteNames[c.HandlerName()]
+}
+
+// isDeflateEncoded reports whether the request Content-Encoding header is deflate
+func (d *DeflateSrvMiddleware) isDeflateEncoded(header string) bool {
+	return withinHeaderLimits(header, d.MaxEncodingHeaderLength, d.MaxEncodingTokens) &&
+		isContentEncoding(header, "deflate", d.LegacyEncodings)
+}
+
+// negotiate reports whether deflate is the coding to answer the Accept-Encoding header with
+func (o *Options) negotiate(header string) bool {
+	if !withinHeaderLimits(header, o.MaxEncodingHeaderLength, o.MaxEncodingTokens) {
+		return false
+	}
+	if acceptedToken(header, "deflate", o.LegacyEncodings) == "" {
+		return false
+	}
+	if len(o.EncodingPriority) == 0 {
+		return true
+	}
+	var supported []string
+	for _, encoding := range o.EncodingPriority {
+		if encoding = strings.ToLower(encoding); encoding == "deflate" || encoding == "identity" {
+			supported = append(supported, encoding)
+		}
+	}
+	encoding, _ := negotiateEncoding(header, supported, o.LegacyEncodings)
+	return encoding == "deflate"
+}
+
+// ShouldCompress reports whether the response to req may be compressed
+func (d *DeflateSrvMiddleware) ShouldCompress(req *protocol.Request) bool {
+	ok, _ := ShouldCompress(d.current().Options, req)
+	return ok
+}
+
+// Reasons returned by ShouldCompress for the requests whose response isn't compressed
+const (
+	ReasonExcludedMethod    = "excluded method"
+	ReasonLoadShedding      = "load shedding"
+	ReasonCDNCompressed     = "compressed by the CDN"
+	ReasonNotAccepted       = "deflate not accepted"
+	ReasonStreaming         = "connection upgrade or event stream"
+	ReasonHTTP10            = "HTTP/1.0 request not naming deflate"
+	ReasonExcludedExtension = "excluded extension"
+	ReasonExcludedPath      = "excluded path"
+	ReasonExcludedPathRegex = "excluded path regex"
+)
+
+// ShouldCompress reports whether the response to req may be compressed by a
+// middleware configured with opts, along with the reason when it may not. It is
+// the decision the middleware takes before running the handler, so caches and
+// other middlewares can tell which variant will be served.
+func ShouldCompress(opts *Options, req *protocol.Request) (bool, string) {
+	if opts.ExcludedMethods[string(req.Method())] {
+		return false, ReasonExcludedMethod
+	}
+	if opts.LoadShedder != nil && opts.LoadShedder() {
+		return false, ReasonLoadShedding
+	}
+	if opts.CDNMode && opts.cdnCompressed(req) {
+		return false, ReasonCDNCompressed
+	}
+
+	header := acceptEncoding(&req.Header)
+	if !opts.negotiate(header) {
+		return false, ReasonNotAccepted
+	}
+	if isStreamingRequest(req) {
+		return false, ReasonStreaming
+	}
+	// HTTP/1.0 clients and probes answering every coding with * get identity
+	// unless they name deflate
+	if req.Header.GetProtocol() == consts.HTTP10 && !opts.CompressHTTP10 &&
+		!namesEncoding(header, "deflate", opts.LegacyEncodings) {
+		return false, ReasonHTTP10
+	}
+
+	path := string(req.URI().RequestURI())
+	if opts.ExcludedExtensions.Matches(path) {
+		return false, ReasonExcludedExtension
+	}
+
+	if excludesPath(opts.ExcludedPaths, opts.excludedPathTrie, path) {
+		return false, ReasonExcludedPath
+	}
+	if opts.ExcludedPathRegexes.Contains(path) {
+		return false, ReasonExcludedPathRegex
+	}
+
+	return true, ""
+}
+
+// hasExplicitContentType reports whether the handler set a Content-Type other
+// than the one Hertz falls back to.
+func hasExplicitContentType(resp *protocol.Response) bool {
+	contentType := resp.Header.ContentType()
+	return len(contentType) > 0 && !bytes.Equal(contentType, defaultContentType)
+}
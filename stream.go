@@ -0,0 +1,201 @@
+package deflate
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"deflate/compress"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/network"
+	"github.com/cloudwego/hertz/pkg/protocol"
+)
+
+// compressStream replaces the response body stream by its deflate encoding,
+// compressed while the server sends it
+func (d *DeflateSrvMiddleware) compressStream(c *app.RequestContext) {
+	size := c.Response.Header.ContentLength()
+	d.setEncodingHeaders(c)
+	d.rewriteStreamHeaders(c)
+	// the size of a stream isn't known, treat it as a large body
+	level := d.levelFor(c, adaptiveLargeBodySize)
+	if d.StreamTrailers {
+		trailer := c.Response.Header.Trailer()
+		// the trailers are declared in the header, their values are set at the end of the body
+		trailer.Set(HeaderUncompressedLength, "")
+		trailer.Set(HeaderUncompressedCRC32, "")
+		c.Response.SetBodyStreamNoReset(&trailerReader{
+			r:       c.Response.BodyStream(),
+			crc:     crc32.NewIEEE(),
+			trailer: trailer,
+		}, size)
+	}
+	if d.ParallelThreshold > 0 && size > d.ParallelThreshold {
+		c.Response.SetBodyStreamNoReset(compress.NewParallelDeflateReader(c.Response.BodyStream(), level), -1)
+		return
+	}
+	c.Response.SetBodyStreamNoReset(compress.NewDeflateReaderSize(c.Response.BodyStream(), level, d.StreamBufferSize), -1)
+}
+
+// rewriteStreamHeaders adjusts the headers derived from the body of a response
+// whose compressed body isn't held in memory
+func (d *DeflateSrvMiddleware) rewriteStreamHeaders(c *app.RequestContext) {
+	policy := d.IntegrityPolicy
+	if policy == IntegrityRecompute {
+		// the compressed body isn't known yet
+		policy = IntegrityDrop
+	}
+	rewriteIntegrityHeaders(&c.Response.Header, nil, policy)
+	d.rewriteETag(c)
+}
+
+// compressSpooled replaces the response body by its deflate encoding spooled
+// to a temporary file, see WithSpooling. reserved is released once the body is
+// sent.
+func (d *DeflateSrvMiddleware) compressSpooled(c *app.RequestContext, body []byte, reserved *reservation) {
+	start := time.Now()
+	r, n, err := compress.DeflateSpooled(body, d.levelFor(c, len(body)), d.SpoolThreshold, d.SpoolDir)
+	d.report(c, start, Stats{
+		Operation:        OperationCompress,
+		CompressedSize:   int(n),
+		UncompressedSize: len(body),
+		Err:              err,
+	})
+	if err != nil {
+		d.onError(c, err)
+		return
+	}
+	d.setEncodingHeaders(c)
+	if d.KeepOriginalBody {
+		c.Set(OriginalBodyKey, append([]byte(nil), body...))
+	}
+	if d.OriginalLengthHeader {
+		c.Response.Header.Set(HeaderOriginalContentLength, strconv.Itoa(len(body)))
+	}
+	d.rewriteStreamHeaders(c)
+	size := int(n)
+	if d.ChunkedResponses {
+		size = -1
+	}
+	// the server closes the stream, removing the file, once it is sent
+	c.Response.SetBodyStream(&budgetReader{Reader: r, r: reserved.take()}, size)
+}
+
+// trailerReader sets the length and CRC-32 of the data read from r as trailers
+// once r is exhausted
+type trailerReader struct {
+	r       io.Reader
+	n       int64
+	crc     hash.Hash32
+	trailer *protocol.Trailer
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+	t.crc.Write(p[:n])
+	if err == io.EOF {
+		t.trailer.Set(HeaderUncompressedLength, strconv.FormatInt(t.n, 10))
+		t.trailer.Set(HeaderUncompressedCRC32, fmt.Sprintf("%08x", t.crc.Sum32()))
+	}
+	return n, err
+}
+
+func (t *trailerReader) Close() error {
+	if c, ok := t.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// claimOwnerKey is the RequestContext key of the middleware which claimed the
+// response before running the next handlers
+const claimOwnerKey = "deflate.claim_owner"
+
+// HijackWriter installs w as the hijack writer of c, wrapped so that what the
+// handler writes is deflate encoded as it is produced when the response may be
+// compressed under the current options. It must be called before anything is
+// flushed. Responses written through a hijack writer are otherwise left
+// untouched by the middleware. They can't be padded nor go through CompressFn,
+// so they are sent uncompressed when either is configured, as they are when
+// another middleware claimed the compression of the response.
+func (d *DeflateSrvMiddleware) HijackWriter(c *app.RequestContext, w network.ExtWriter) {
+	owner := d.owner()
+	d = d.current()
+	if !d.hijackable(c) {
+		c.Response.HijackWriter(w)
+		return
+	}
+	// the middleware claims the response itself when the handler runs within it
+	if v, _ := c.Get(claimOwnerKey); v != owner && !ClaimCompression(c) {
+		c.Response.HijackWriter(w)
+		return
+	}
+	d.setEncodingHeaders(c)
+	// the size of the output isn't known, treat it as a large body
+	zw := compress.NewStacklessDeflateWriter(w, d.levelFor(c, adaptiveLargeBodySize))
+	c.Response.HijackWriter(&hijackWriter{zw: zw, w: w})
+}
+
+// hijackable reports whether what the handler writes through a hijack writer
+// may be compressed, making the checks the middleware makes on other responses
+func (d *DeflateSrvMiddleware) hijackable(c *app.RequestContext) bool {
+	if d.CompressFn != nil || d.RandomPadding > 0 || d.PaddingBlock > 1 || d.DryRun {
+		return false
+	}
+	var ok bool
+	var reason string
+	if d.ShouldCompressFunc != nil {
+		ok = d.ShouldCompressFunc(&c.Request)
+	} else {
+		ok, reason = ShouldCompress(d.Options, &c.Request)
+	}
+	if !ok {
+		if d.ExplicitIdentity && (reason == ReasonNotAccepted || reason == ReasonHTTP10) {
+			d.setIdentityHeaders(c)
+		}
+		return false
+	}
+	if optedOut(c) || IsResponseEncoded(&c.Response) || d.isExcludedRoute(c) || !d.applyPolicy(c) {
+		return false
+	}
+	if c.Response.StatusCode() == http.StatusNotModified || isMediaType(c.Response.Header.ContentType(), "text/event-stream") {
+		return false
+	}
+	if len(d.IncludedContentTypes) > 0 && !d.isIncludedContentType(c.Response.Header.ContentType()) {
+		return false
+	}
+	if d.CDNMode && d.cdnSkip(c) {
+		return false
+	}
+	return d.SecretAwareSkip == nil || !d.SecretAwareSkip(c)
+}
+
+type hijackWriter struct {
+	zw *compress.StacklessDeflateWriter
+	w  network.ExtWriter
+}
+
+func (h *hijackWriter) Write(p []byte) (int, error) {
+	return h.zw.Write(p)
+}
+
+func (h *hijackWriter) Flush() error {
+	if err := h.zw.Flush(); err != nil {
+		return err
+	}
+	return h.w.Flush()
+}
+
+// Finalize ends the deflate stream, giving the writer back to the pool, and
+// finalizes w
+func (h *hijackWriter) Finalize() error {
+	if err := h.zw.Close(); err != nil {
+		return err
+	}
+	return h.w.Finalize()
+}
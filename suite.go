@@ -0,0 +1,73 @@
+package deflate
+
+import (
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+)
+
+// SuiteOption configures both middlewares returned by NewSuite
+type SuiteOption func(o *Options, co *ClientOptions)
+
+// NewSuite returns a server and a client middleware sharing one option set, so
+// a service and its internal clients stay consistent
+func NewSuite(level int, opts ...SuiteOption) (app.HandlerFunc, client.Middleware) {
+	// the options are set up before the constructors, which derive state
+	// such as the decompression limit from them
+	options := *DefaultOptions
+	options.Level = level
+	clientOptions := *DefaultClientOptions
+	for _, fn := range opts {
+		fn(&options, &clientOptions)
+	}
+	srv := NewDeflateSrvMiddleware(level, func(o *Options) { *o = options })
+	cli := NewDeflateClientMiddleware(level, func(o *ClientOptions) { *o = clientOptions })
+	return srv.SrvMiddleware, cli.ClientMiddleware
+}
+
+// WithSuiteOptions applies a server option and its client counterpart, either
+// may be nil for options which only exist on one side
+func WithSuiteOptions(srv Option, cli ClientOption) SuiteOption {
+	return func(o *Options, co *ClientOptions) {
+		if srv != nil {
+			srv(o)
+		}
+		if cli != nil {
+			cli(co)
+		}
+	}
+}
+
+// WithSuiteExcludedExtensions customize excluded extensions
+func WithSuiteExcludedExtensions(args []string) SuiteOption {
+	return WithSuiteOptions(WithExcludedExtensions(args), WithExcludedExtensionsForClient(args))
+}
+
+// WithSuiteExcludedPaths customize excluded paths
+func WithSuiteExcludedPaths(args []string) SuiteOption {
+	return WithSuiteOptions(WithExcludedPaths(args), WithExcludedPathsForClient(args))
+}
+
+// WithSuiteExcludedPathRegexes customize paths' regexes
+func WithSuiteExcludedPathRegexes(args []string) SuiteOption {
+	return WithSuiteOptions(WithExcludedPathRegexes(args), WithExcludedPathRegexesForClient(args))
+}
+
+// WithSuiteDecompression decompresses deflate requests on the server and deflate responses on the client
+func WithSuiteDecompression() SuiteOption {
+	return WithSuiteOptions(WithDecompressFn(DefaultDecompressHandle), WithDecompressFnForClient(DefaultDecompressMiddlewareForClient))
+}
+
+// WithSuiteAdaptiveLevel picks the level from the body size on both sides
+func WithSuiteAdaptiveLevel() SuiteOption {
+	return WithSuiteOptions(WithAdaptiveLevel(), WithAdaptiveLevelForClient())
+}
+
+// WithSuiteMemoryBudget shares budget between the server and the client
+func WithSuiteMemoryBudget(budget *MemoryBudget) SuiteOption {
+	return WithSuiteOptions(WithMemoryBudget(budget), WithMemoryBudgetForClient(budget))
+}
+
+// WithoutSuiteVaryHeader stops emitting Vary: Accept-Encoding on both sides
+func WithoutSuiteVaryHeader() SuiteOption {
+	return WithSuiteOptions(WithoutVaryHeader(), WithoutVaryHeaderForClient())
+}
@@ -0,0 +1,56 @@
+package deflate
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// encodingTokensCacheSize bounds the number of distinct Accept-Encoding and
+// Content-Encoding headers whose parsed codings are cached
+const encodingTokensCacheSize = 256
+
+// encodingTokensCache saves parsing the few distinct headers sent by clients
+// again for every request
+var encodingTokensCache = newTokensCache(encodingTokensCacheSize)
+
+// tokensCache is a bounded cache of parsed coding lists keyed by the raw
+// header. Reads take no lock, so concurrent requests don't contend on it. Once
+// full it starts over empty: the headers in use are cached again at their
+// next request, while those seen once, e.g. sent by a scanner, are dropped.
+type tokensCache struct {
+	size    int
+	entries atomic.Pointer[sync.Map]
+	n       atomic.Int64
+}
+
+func newTokensCache(size int) *tokensCache {
+	c := &tokensCache{size: size}
+	c.entries.Store(&sync.Map{})
+	return c
+}
+
+// get returns the tokens cached for header, which must not be modified
+func (c *tokensCache) get(header string) ([]encodingToken, bool) {
+	v, ok := c.entries.Load().Load(header)
+	if !ok {
+		return nil, false
+	}
+	return v.([]encodingToken), true
+}
+
+func (c *tokensCache) add(header string, tokens []encodingToken) {
+	entries := c.entries.Load()
+	if _, ok := entries.Load(header); ok {
+		return
+	}
+	if c.n.Add(1) > int64(c.size) {
+		// concurrent adds may both start over, dropping an entry at worst
+		if c.entries.CompareAndSwap(entries, &sync.Map{}) {
+			c.n.Store(1)
+		}
+		entries = c.entries.Load()
+	}
+	if _, loaded := entries.LoadOrStore(header, tokens); loaded {
+		c.n.Add(-1)
+	}
+}
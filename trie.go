@@ -0,0 +1,70 @@
+package deflate
+
+// pathTrieThreshold is the number of excluded paths above which they are
+// matched with a pathTrie rather than scanned one by one
+const pathTrieThreshold = 32
+
+// pathTrie matches the request URI against all the prefixes of an
+// ExcludedPaths in a single walk of the URI
+type pathTrie struct {
+	// paths is the ExcludedPaths the trie was compiled from, to detect that
+	// the options were given another one since
+	paths ExcludedPaths
+	root  trieNode
+}
+
+type trieNode struct {
+	children map[byte]*trieNode
+	// terminal marks the end of an excluded prefix
+	terminal bool
+}
+
+// compilePaths returns the pathTrie matching paths, or nil when there are too
+// few of them for a trie to be worth it
+func compilePaths(paths ExcludedPaths) *pathTrie {
+	if len(paths) <= pathTrieThreshold {
+		return nil
+	}
+	t := &pathTrie{paths: paths}
+	for _, path := range paths {
+		node := &t.root
+		for i := 0; i < len(path); i++ {
+			child := node.children[path[i]]
+			if child == nil {
+				if node.children == nil {
+					node.children = make(map[byte]*trieNode)
+				}
+				child = &trieNode{}
+				node.children[path[i]] = child
+			}
+			node = child
+		}
+		node.terminal = true
+	}
+	return t
+}
+
+// contains reports whether requestURI starts with one of the paths of t
+func (t *pathTrie) contains(requestURI string) bool {
+	node := &t.root
+	for i := 0; ; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == len(requestURI) {
+			return false
+		}
+		if node = node.children[requestURI[i]]; node == nil {
+			return false
+		}
+	}
+}
+
+// excludesPath reports whether paths contains a prefix of requestURI, using
+// trie when it was compiled from paths
+func excludesPath(paths ExcludedPaths, trie *pathTrie, requestURI string) bool {
+	if trie != nil && len(trie.paths) == len(paths) && &trie.paths[0] == &paths[0] {
+		return trie.contains(requestURI)
+	}
+	return paths.Contains(requestURI)
+}